@@ -0,0 +1,99 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+
+	"git.icyphox.sh/legit/config"
+	"git.icyphox.sh/legit/routes"
+	"gopkg.in/yaml.v3"
+)
+
+// configSource is where the config comes from: a file and overrides
+// from the command line.
+type configSource struct {
+	path      string
+	overrides []string
+}
+
+// configFlags registers --config, plus a flag for every config option
+// (like --server.port), on fs.
+func configFlags(fs *flag.FlagSet) *configSource {
+	src := &configSource{}
+	fs.StringVar(&src.path, "config", "", "path to config file (default ./config.yaml, if it exists)")
+
+	for _, key := range config.Keys() {
+		fs.Func(key, fmt.Sprintf("set %s (also $%s)", key, config.EnvName(key)), func(v string) error {
+			src.overrides = append(src.overrides, key+"="+v)
+			return nil
+		})
+	}
+
+	return src
+}
+
+// file returns the config file in use, or "" if there is none.
+func (src *configSource) file() string {
+	if src.path == "" {
+		if _, err := os.Stat("config.yaml"); err == nil {
+			return "config.yaml"
+		}
+	}
+	return src.path
+}
+
+// load reads the config; it can be called again to re-read it.
+func (src *configSource) load() (*config.Config, error) {
+	return config.Read(src.file(), src.overrides...)
+}
+
+// check implements 'legit check': it reads and validates the config
+// without starting the server, printing every problem it finds and
+// exiting non-zero if there were any.
+func check(args []string) {
+	fs := flag.NewFlagSet("check", flag.ExitOnError)
+	src := configFlags(fs)
+	fs.Parse(args)
+
+	c, err := src.load()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	if err := errors.Join(c.Validate(), routes.CheckTemplates(c, assets)); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	fmt.Println("ok")
+}
+
+// configDump implements 'legit config dump', which prints the effective
+// config after defaults, file, environment and flags have been merged.
+func configDump(args []string) {
+	if len(args) == 0 || args[0] != "dump" {
+		fmt.Fprintln(os.Stderr, "usage: legit config dump [flags]")
+		os.Exit(2)
+	}
+
+	fs := flag.NewFlagSet("config dump", flag.ExitOnError)
+	src := configFlags(fs)
+	fs.Parse(args[1:])
+
+	c, err := src.load()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	enc := yaml.NewEncoder(os.Stdout)
+	enc.SetIndent(2)
+	// Secrets aren't for terminals and bug reports.
+	if err := enc.Encode(c.Redacted()); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
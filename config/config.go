@@ -1,18 +1,48 @@
 package config
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"net/url"
 	"os"
+	"path/filepath"
+	"strings"
+	"time"
 
 	"gopkg.in/yaml.v3"
 )
 
+// Values for meta.fonts.
+const (
+	FontsCDN  = "cdn"
+	FontsSelf = "self"
+	FontsNone = "none"
+)
+
+// SelfFonts are the Inter files static/inter.css loads with meta.fonts:
+// self. They aren't bundled, and need to be in dirs.static.
+var SelfFonts = []string{"InterVariable.woff2", "InterVariable-Italic.woff2"}
+
 type Config struct {
 	Repo struct {
-		ScanPath   string   `yaml:"scanPath"`
-		Readme     []string `yaml:"readme"`
-		MainBranch []string `yaml:"mainBranch"`
-		Ignore     []string `yaml:"ignore,omitempty"`
+		ScanPath   ScanPaths `yaml:"scanPath"`
+		Readme     []string  `yaml:"readme"`
+		MainBranch []string  `yaml:"mainBranch"`
+		// Ignore and Include take globs, or regexps after "re:", that are
+		// matched against both the repo's name and its directory. With
+		// Include set, only repos matching it are shown.
+		Ignore  []string `yaml:"ignore,omitempty"`
+		Include []string `yaml:"include,omitempty"`
+		// ExportOk is the name of a file, like git-daemon-export-ok, that
+		// has to be in a repo's git directory for it to be shown.
+		ExportOk string `yaml:"exportOk,omitempty"`
+		// Repos that are symlinks out of their scan path are only served
+		// with FollowSymlinks set.
+		FollowSymlinks bool `yaml:"followSymlinks,omitempty"`
 	} `yaml:"repo"`
 	Dirs struct {
 		Templates string `yaml:"templates"`
@@ -21,24 +51,406 @@ type Config struct {
 	Meta struct {
 		Title       string `yaml:"title"`
 		Description string `yaml:"description"`
+		// Where the Inter font comes from: cdn, self (static/inter.css,
+		// with the font files, which aren't bundled, in dirs.static) or
+		// none.
+		Fonts string `yaml:"fonts,omitempty"`
 	} `yaml:"meta"`
 	Server struct {
-		Name string `yaml:"name,omitempty"`
-		Host string `yaml:"host"`
-		Port int    `yaml:"port"`
+		Name   string `yaml:"name,omitempty"`
+		Host   string `yaml:"host"`
+		Port   int    `yaml:"port"`
+		Socket string `yaml:"socket,omitempty"`
+		// Path prefix legit is mounted under, like /git.
+		BasePath string `yaml:"basePath,omitempty"`
+
+		ReadTimeout     time.Duration `yaml:"readTimeout,omitempty"`
+		WriteTimeout    time.Duration `yaml:"writeTimeout,omitempty"`
+		IdleTimeout     time.Duration `yaml:"idleTimeout,omitempty"`
+		ShutdownTimeout time.Duration `yaml:"shutdownTimeout,omitempty"`
+
+		TLS struct {
+			Cert string `yaml:"cert,omitempty"`
+			Key  string `yaml:"key,omitempty"`
+		} `yaml:"tls,omitempty"`
+
+		// Security headers sent with every response. An empty CSP gets
+		// a policy that fits the default templates, "off" sends none.
+		// HSTS is only sent over TLS, and not at all if zero.
+		Headers struct {
+			CSP            string        `yaml:"csp,omitempty"`
+			ReferrerPolicy string        `yaml:"referrerPolicy,omitempty"`
+			FrameOptions   string        `yaml:"frameOptions,omitempty"`
+			HSTS           time.Duration `yaml:"hsts,omitempty"`
+		} `yaml:"headers"`
 	} `yaml:"server"`
+	Log struct {
+		Level  string `yaml:"level,omitempty"`
+		Format string `yaml:"format,omitempty"`
+		Output string `yaml:"output,omitempty"`
+	} `yaml:"log"`
+	Metrics struct {
+		Addr string `yaml:"addr,omitempty"`
+	} `yaml:"metrics"`
+	Daemon struct {
+		// Serve git:// clones on this address, like :9418, if set.
+		Addr string `yaml:"addr,omitempty"`
+		// How many connections are served at once; zero means no limit.
+		MaxConns int `yaml:"maxConns,omitempty"`
+		// How long a client has to say what it wants, and how long it may
+		// then go without sending or receiving anything.
+		InitTimeout time.Duration `yaml:"initTimeout,omitempty"`
+		Timeout     time.Duration `yaml:"timeout,omitempty"`
+	} `yaml:"daemon"`
+	Limits struct {
+		// Per client, for pages and for clones. Clients are told apart
+		// by ClientHeader, like X-Forwarded-User from an authenticating
+		// proxy, if it comes from one of TrustedProxies, or else by
+		// their address.
+		Browse       Rate   `yaml:"browse"`
+		Clone        Rate   `yaml:"clone"`
+		ClientHeader string `yaml:"clientHeader,omitempty"`
+		// Addresses and networks of proxies in front of legit, and unix
+		// for server.socket. Requests from them are taken to be from the
+		// address in X-Forwarded-For or X-Real-IP.
+		TrustedProxies []string `yaml:"trustedProxies,omitempty"`
+		// How many packs are generated at once, and how many clones may
+		// wait, for at most PackWait, for their turn. Zero means no limit.
+		Packs     int           `yaml:"packs,omitempty"`
+		PackQueue int           `yaml:"packQueue,omitempty"`
+		PackWait  time.Duration `yaml:"packWait,omitempty"`
+		// Largest request body git clients may send, in bytes, both as
+		// sent and decompressed. Zero means no limit.
+		RequestBody int64 `yaml:"requestBody,omitempty"`
+	} `yaml:"limits"`
+	Hooks struct {
+		// Directory webhook deliveries wait in to be sent, and are logged
+		// in after. Both legit and the post-receive hook write to it.
+		Queue string `yaml:"queue,omitempty"`
+		// How many times a delivery is tried before it's given up on.
+		Attempts int       `yaml:"attempts,omitempty"`
+		Webhooks []Webhook `yaml:"webhooks,omitempty"`
+		// Show repos' deliveries at /<repo>/webhooks, to anyone. Off by
+		// default, as hosts and errors can say a lot about a network.
+		ShowLog bool `yaml:"showLog,omitempty"`
+	} `yaml:"hooks"`
+	Sandbox struct {
+		// Refuse to start if filesystem access can't be restricted with
+		// unveil(2) or Landlock.
+		Require bool `yaml:"require,omitempty"`
+	} `yaml:"sandbox"`
 }
 
-func Read(f string) (*Config, error) {
-	b, err := os.ReadFile(f)
-	if err != nil {
-		return nil, fmt.Errorf("reading config: %w", err)
+// Webhook is a URL that pushes to repos matching Repos, or to any repo
+// if it's empty, are posted to. With a Secret, payloads are signed with
+// HMAC-SHA256.
+type Webhook struct {
+	URL    string   `yaml:"url"`
+	Secret string   `yaml:"secret,omitempty"`
+	Repos  []string `yaml:"repos,omitempty"`
+}
+
+// Rate is a token bucket: Rate requests a second on average, in bursts
+// of up to Burst. A zero Rate means no limit.
+type Rate struct {
+	Rate  float64 `yaml:"rate,omitempty"`
+	Burst int     `yaml:"burst,omitempty"`
+}
+
+func (r Rate) check() error {
+	if r.Rate < 0 || r.Burst < 0 || (r.Rate > 0 && r.Burst == 0) {
+		return errors.New("rate and burst must be positive")
 	}
+	return nil
+}
 
+// Default returns the built-in defaults everything else is layered on.
+func Default() *Config {
 	c := Config{}
-	if err := yaml.Unmarshal(b, &c); err != nil {
-		return nil, fmt.Errorf("parsing config: %w", err)
+	c.Repo.Readme = []string{"readme", "README", "readme.md", "README.md"}
+	c.Repo.MainBranch = []string{"master", "main"}
+	c.Meta.Title = "legit"
+	c.Meta.Fonts = FontsCDN
+	c.Server.Host = "127.0.0.1"
+	c.Server.Port = 5555
+	// Clones of big repos can take a while, so writes aren't bounded
+	// unless asked to.
+	c.Server.ReadTimeout = 30 * time.Second
+	c.Server.IdleTimeout = 2 * time.Minute
+	c.Server.ShutdownTimeout = 30 * time.Second
+	c.Server.Headers.ReferrerPolicy = "same-origin"
+	c.Server.Headers.FrameOptions = "DENY"
+	c.Server.Headers.HSTS = 365 * 24 * time.Hour
+	c.Limits.PackWait = 30 * time.Second
+	c.Limits.RequestBody = 10 << 20
+	c.Hooks.Attempts = 8
+	c.Daemon.MaxConns = 32
+	c.Daemon.InitTimeout = 10 * time.Second
+	c.Daemon.Timeout = 2 * time.Minute
+	c.Log.Level = "info"
+	c.Log.Format = "text"
+	c.Log.Output = "stderr"
+	return &c
+}
+
+// Read builds the effective config by layering, in increasing order of
+// precedence: the defaults, the YAML file f (skipped if f is empty),
+// LEGIT_* environment variables, and overrides given as key=value pairs
+// like "server.port=8080".
+func Read(f string, overrides ...string) (*Config, error) {
+	c := Default()
+
+	if f != "" {
+		b, err := os.ReadFile(f)
+		if err != nil {
+			return nil, fmt.Errorf("reading config: %w", err)
+		}
+
+		// Unknown keys are most likely typos, which would otherwise leave
+		// the option they were meant for silently unset.
+		dec := yaml.NewDecoder(bytes.NewReader(b))
+		dec.KnownFields(true)
+		if err := dec.Decode(c); err != nil && !errors.Is(err, io.EOF) {
+			return nil, fmt.Errorf("parsing config: %w", tidyYAMLError(err))
+		}
 	}
 
-	return &c, nil
+	if err := c.applyEnv(os.Environ()); err != nil {
+		return nil, err
+	}
+
+	for _, o := range overrides {
+		key, value, _ := strings.Cut(o, "=")
+		if err := c.Set(key, value); err != nil {
+			return nil, err
+		}
+	}
+
+	for i := range c.Repo.ScanPath {
+		c.Repo.ScanPath[i].Prefix = strings.Trim(c.Repo.ScanPath[i].Prefix, "/")
+	}
+
+	c.Server.BasePath = strings.TrimRight(c.Server.BasePath, "/")
+	if c.Server.BasePath != "" && !strings.HasPrefix(c.Server.BasePath, "/") {
+		c.Server.BasePath = "/" + c.Server.BasePath
+	}
+
+	return c, nil
+}
+
+// Validate checks the config for problems that would keep legit from
+// working, and returns all of them joined together.
+func (c *Config) Validate() error {
+	var errs []error
+
+	if len(c.Repo.ScanPath) == 0 {
+		errs = append(errs, errors.New("repo.scanPath: not set"))
+	}
+	prefixes := map[string]bool{}
+	for _, sp := range c.Repo.ScanPath {
+		if sp.Path == "" {
+			errs = append(errs, errors.New("repo.scanPath: entry without a path"))
+		} else if err := isDir(sp.Path); err != nil {
+			errs = append(errs, fmt.Errorf("repo.scanPath: %w", err))
+		}
+
+		if strings.Contains(sp.Prefix, "/") || sp.Prefix == "static" {
+			errs = append(errs, fmt.Errorf("repo.scanPath: prefix %q must be a single path segment other than static", sp.Prefix))
+		}
+		if sp.Prefix != "" && prefixes[sp.Prefix] {
+			errs = append(errs, fmt.Errorf("repo.scanPath: prefix %q is used more than once", sp.Prefix))
+		}
+		prefixes[sp.Prefix] = true
+
+		switch sp.Visibility {
+		case "", Public, Hidden:
+		default:
+			errs = append(errs, fmt.Errorf("repo.scanPath: %s: unknown visibility %q", sp.Path, sp.Visibility))
+		}
+
+		for _, p := range sp.Ignore {
+			if err := checkPattern(p); err != nil {
+				errs = append(errs, fmt.Errorf("repo.scanPath: %s: ignore %q: %w", sp.Path, p, err))
+			}
+		}
+	}
+
+	for _, p := range c.Repo.Ignore {
+		if err := checkPattern(p); err != nil {
+			errs = append(errs, fmt.Errorf("repo.ignore: %q: %w", p, err))
+		}
+	}
+	for _, p := range c.Repo.Include {
+		if err := checkPattern(p); err != nil {
+			errs = append(errs, fmt.Errorf("repo.include: %q: %w", p, err))
+		}
+	}
+	if strings.ContainsAny(c.Repo.ExportOk, `/\`) {
+		errs = append(errs, fmt.Errorf("repo.exportOk: %q must be a file name", c.Repo.ExportOk))
+	}
+
+	switch c.Meta.Fonts {
+	case FontsCDN, FontsNone:
+	case FontsSelf:
+		// The font files aren't bundled.
+		for _, f := range SelfFonts {
+			if c.Dirs.Static == "" {
+				errs = append(errs, fmt.Errorf("meta.fonts: self needs %s in dirs.static, which isn't set", f))
+			} else if _, err := os.Stat(filepath.Join(c.Dirs.Static, f)); err != nil {
+				errs = append(errs, fmt.Errorf("meta.fonts: self needs %s in dirs.static: %w", f, err))
+			}
+		}
+	default:
+		errs = append(errs, fmt.Errorf("meta.fonts: unknown value %q", c.Meta.Fonts))
+	}
+
+	if err := c.Limits.Browse.check(); err != nil {
+		errs = append(errs, fmt.Errorf("limits.browse: %w", err))
+	}
+	if err := c.Limits.Clone.check(); err != nil {
+		errs = append(errs, fmt.Errorf("limits.clone: %w", err))
+	}
+	_, unix, err := ParseProxies(c.Limits.TrustedProxies)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("limits.trustedProxies: %w", err))
+	}
+	// Everyone comes in through the socket from the same place, and
+	// only proxies get to say who they're passing on.
+	if c.Server.Socket != "" && (c.Limits.Browse.Rate > 0 || c.Limits.Clone.Rate > 0) && !unix {
+		errs = append(errs, errors.New("limits: clients can't be told apart over server.socket without unix in limits.trustedProxies"))
+	}
+	if c.Limits.ClientHeader != "" && len(c.Limits.TrustedProxies) == 0 {
+		errs = append(errs, errors.New("limits.clientHeader: only taken from limits.trustedProxies, which is empty"))
+	}
+	if c.Limits.Packs < 0 || c.Limits.PackQueue < 0 || c.Limits.PackWait < 0 || c.Limits.RequestBody < 0 {
+		errs = append(errs, errors.New("limits: packs, packQueue, packWait and requestBody can't be negative"))
+	}
+
+	if len(c.Hooks.Webhooks) > 0 && c.Hooks.Queue == "" {
+		errs = append(errs, errors.New("hooks.queue: needs to be set for webhooks"))
+	} else if c.Hooks.Queue != "" {
+		if err := isDir(c.Hooks.Queue); err != nil {
+			errs = append(errs, fmt.Errorf("hooks.queue: %w", err))
+		}
+	}
+	if c.Hooks.Attempts < 1 {
+		errs = append(errs, errors.New("hooks.attempts: must be at least 1"))
+	}
+	for _, wh := range c.Hooks.Webhooks {
+		if u, err := url.Parse(wh.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, fmt.Errorf("hooks.webhooks: %q isn't an http(s) URL", wh.URL))
+		}
+		for _, p := range wh.Repos {
+			if err := checkPattern(p); err != nil {
+				errs = append(errs, fmt.Errorf("hooks.webhooks: %s: repos %q: %w", wh.URL, p, err))
+			}
+		}
+	}
+
+	if len(c.Repo.MainBranch) == 0 {
+		errs = append(errs, errors.New("repo.mainBranch: needs at least one branch name"))
+	}
+	for _, b := range c.Repo.MainBranch {
+		if strings.TrimSpace(b) == "" {
+			errs = append(errs, errors.New("repo.mainBranch: empty branch name"))
+		}
+	}
+
+	if c.Dirs.Templates != "" {
+		if err := isDir(c.Dirs.Templates); err != nil {
+			errs = append(errs, fmt.Errorf("dirs.templates: %w", err))
+		}
+	}
+	if c.Dirs.Static != "" {
+		if err := isDir(c.Dirs.Static); err != nil {
+			errs = append(errs, fmt.Errorf("dirs.static: %w", err))
+		}
+	}
+
+	if c.Server.Socket == "" && (c.Server.Port < 1 || c.Server.Port > 65535) {
+		errs = append(errs, fmt.Errorf("server.port: %d is out of range", c.Server.Port))
+	}
+
+	if (c.Server.TLS.Cert == "") != (c.Server.TLS.Key == "") {
+		errs = append(errs, errors.New("server.tls: both cert and key need to be set"))
+	}
+
+	if c.Daemon.Addr != "" {
+		if _, _, err := net.SplitHostPort(c.Daemon.Addr); err != nil {
+			errs = append(errs, fmt.Errorf("daemon.addr: %w", err))
+		}
+	}
+	if c.Daemon.MaxConns < 0 || c.Daemon.InitTimeout < 0 || c.Daemon.Timeout < 0 {
+		errs = append(errs, errors.New("daemon: maxConns, initTimeout and timeout can't be negative"))
+	}
+
+	return errors.Join(errs...)
+}
+
+// Redacted returns a copy of c with webhook secrets, and passwords in
+// webhook URLs, blanked out, for showing.
+func (c *Config) Redacted() *Config {
+	r := *c
+	r.Hooks.Webhooks = make([]Webhook, len(c.Hooks.Webhooks))
+	for i, wh := range c.Hooks.Webhooks {
+		if wh.Secret != "" {
+			wh.Secret = "REDACTED"
+		}
+		if u, err := url.Parse(wh.URL); err == nil {
+			wh.URL = u.Redacted()
+		}
+		r.Hooks.Webhooks[i] = wh
+	}
+	return &r
+}
+
+// tidyYAMLError drops the Go type names yaml.v3 puts in its errors about
+// unknown fields, which for our anonymous structs are just noise.
+func tidyYAMLError(err error) error {
+	var te *yaml.TypeError
+	if !errors.As(err, &te) {
+		return err
+	}
+
+	errs := make([]error, len(te.Errors))
+	for i, e := range te.Errors {
+		if before, _, ok := strings.Cut(e, " in type "); ok {
+			e = before
+		}
+		errs[i] = errors.New(e)
+	}
+
+	return errors.Join(errs...)
+}
+
+func isDir(path string) error {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return fmt.Errorf("%s: not a directory", path)
+	}
+	return nil
+}
+
+// ParseProxies parses limits.trustedProxies into networks, a single
+// address being a network of one, and whether unix is among them.
+func ParseProxies(proxies []string) (nets []netip.Prefix, unix bool, err error) {
+	for _, p := range proxies {
+		if p == "unix" {
+			unix = true
+			continue
+		}
+		if addr, err := netip.ParseAddr(p); err == nil {
+			nets = append(nets, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+			continue
+		}
+		n, err := netip.ParsePrefix(p)
+		if err != nil {
+			return nil, false, fmt.Errorf("%q is neither an address nor a network", p)
+		}
+		nets = append(nets, n.Masked())
+	}
+	return nets, unix, nil
 }
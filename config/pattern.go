@@ -0,0 +1,62 @@
+package config
+
+import (
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// Patterns in repo.ignore and repo.include are globs, as in path.Match,
+// unless they start with regexPrefix, in which case the rest is a regular
+// expression. A plain name is a glob that matches only itself.
+const regexPrefix = "re:"
+
+var regexps sync.Map // string -> *regexp.Regexp
+
+// Match reports whether name matches pattern. Invalid patterns, which
+// Validate reports, match nothing.
+func Match(pattern, name string) bool {
+	if expr, ok := strings.CutPrefix(pattern, regexPrefix); ok {
+		re, err := compile(expr)
+		return err == nil && re.MatchString(name)
+	}
+
+	ok, _ := path.Match(pattern, name)
+	return ok
+}
+
+// MatchAny reports whether any of names matches any of patterns.
+func MatchAny(patterns []string, names ...string) bool {
+	for _, p := range patterns {
+		for _, n := range names {
+			if Match(p, n) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func compile(expr string) (*regexp.Regexp, error) {
+	if re, ok := regexps.Load(expr); ok {
+		return re.(*regexp.Regexp), nil
+	}
+
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, err
+	}
+	regexps.Store(expr, re)
+	return re, nil
+}
+
+func checkPattern(pattern string) error {
+	if expr, ok := strings.CutPrefix(pattern, regexPrefix); ok {
+		_, err := compile(expr)
+		return err
+	}
+
+	_, err := path.Match(pattern, "")
+	return err
+}
@@ -0,0 +1,95 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Visibility of the repos in a scan path.
+const (
+	// Public repos are listed on the index and served.
+	Public = "public"
+	// Hidden repos are neither listed nor served.
+	Hidden = "hidden"
+)
+
+// ScanPath is a directory of repos, with its own settings.
+type ScanPath struct {
+	Path string `yaml:"path"`
+	// Prefix is prepended to the names of the repos found here, so that
+	// /mirrors/foo is foo in the scan path with prefix mirrors. Repos
+	// from scan paths without one are at the top level.
+	Prefix string `yaml:"prefix,omitempty"`
+	// Ignore and Readme add to repo.ignore and take precedence over
+	// repo.readme, respectively.
+	Ignore     []string `yaml:"ignore,omitempty"`
+	Readme     []string `yaml:"readme,omitempty"`
+	Visibility string   `yaml:"visibility,omitempty"`
+}
+
+// ScanPaths is repo.scanPath, which is either a single path or a list of
+// scan path entries.
+type ScanPaths []ScanPath
+
+func (s *ScanPaths) UnmarshalYAML(n *yaml.Node) error {
+	if n.Kind == yaml.ScalarNode {
+		*s = ScanPaths{{Path: n.Value}}
+		return nil
+	}
+
+	if n.Kind != yaml.SequenceNode {
+		return fmt.Errorf("line %d: scanPath must be a path or a list", n.Line)
+	}
+
+	// Decoding through a node doesn't carry over KnownFields, so check
+	// the keys ourselves.
+	paths := ScanPaths{}
+	for _, item := range n.Content {
+		if item.Kind == yaml.ScalarNode {
+			paths = append(paths, ScanPath{Path: item.Value})
+			continue
+		}
+
+		for i := 0; i+1 < len(item.Content); i += 2 {
+			switch k := item.Content[i]; k.Value {
+			case "path", "prefix", "ignore", "readme", "visibility":
+			default:
+				return fmt.Errorf("line %d: field %s not found", k.Line, k.Value)
+			}
+		}
+
+		var sp ScanPath
+		if err := item.Decode(&sp); err != nil {
+			return err
+		}
+		paths = append(paths, sp)
+	}
+
+	*s = paths
+	return nil
+}
+
+// MarshalYAML writes a lone scan path without settings back as a plain
+// path.
+func (s ScanPaths) MarshalYAML() (any, error) {
+	if len(s) == 1 && s[0].Prefix == "" && s[0].Ignore == nil &&
+		s[0].Readme == nil && s[0].Visibility == "" {
+		return s[0].Path, nil
+	}
+	return []ScanPath(s), nil
+}
+
+// UnmarshalText sets scan paths from the environment or the command
+// line, as a comma separated list of paths.
+func (s *ScanPaths) UnmarshalText(b []byte) error {
+	paths := ScanPaths{}
+	for _, p := range strings.Split(string(b), ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			paths = append(paths, ScanPath{Path: p})
+		}
+	}
+	*s = paths
+	return nil
+}
@@ -1,8 +1,9 @@
 package git
 
 import (
+	"context"
 	"fmt"
-	"log"
+	"log/slog"
 	"strings"
 
 	"github.com/bluekeyes/go-gitdiff/gitdiff"
@@ -41,7 +42,7 @@ type NiceDiff struct {
 	Diff []Diff
 }
 
-func (g *GitRepo) Diff() (*NiceDiff, error) {
+func (g *GitRepo) Diff(ctx context.Context) (*NiceDiff, error) {
 	c, err := g.r.CommitObject(g.h)
 	if err != nil {
 		return nil, fmt.Errorf("commit object: %w", err)
@@ -73,7 +74,7 @@ func (g *GitRepo) Diff() (*NiceDiff, error) {
 
 	diffs, _, err := gitdiff.Parse(strings.NewReader(patch.String()))
 	if err != nil {
-		log.Println(err)
+		slog.WarnContext(ctx, "parsing diff", "commit", g.h.String(), "err", err)
 	}
 
 	nd := NiceDiff{}
@@ -0,0 +1,68 @@
+package git
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Filter leaves objects out of a pack for a partial clone, as described
+// under --filter in git-rev-list(1). The zero Filter leaves nothing out.
+type Filter struct {
+	// Leave out blobs of BlobLimit bytes or more.
+	LimitBlobs bool
+	BlobLimit  int64
+	// Leave out trees and blobs TreeDepth or more levels below the root
+	// tree.
+	LimitTrees bool
+	TreeDepth  int
+}
+
+// ParseFilter parses a filter spec: blob:none, blob:limit=<n>[kmg] or
+// tree:<depth>.
+func ParseFilter(spec string) (Filter, error) {
+	switch kind, arg, _ := strings.Cut(spec, ":"); {
+	case spec == "blob:none":
+		return Filter{LimitBlobs: true}, nil
+	case kind == "blob" && strings.HasPrefix(arg, "limit="):
+		n, err := parseSize(strings.TrimPrefix(arg, "limit="))
+		if err != nil {
+			return Filter{}, fmt.Errorf("filter %q: %w", spec, err)
+		}
+		return Filter{LimitBlobs: true, BlobLimit: n}, nil
+	case kind == "tree":
+		n, err := strconv.Atoi(arg)
+		if err != nil || n < 0 {
+			return Filter{}, fmt.Errorf("filter %q: bad depth", spec)
+		}
+		return Filter{LimitTrees: true, TreeDepth: n}, nil
+	}
+	return Filter{}, fmt.Errorf("filter %q: not supported", spec)
+}
+
+// parseSize parses a size with an optional k, m or g suffix, in powers
+// of 1024 as git does.
+func parseSize(s string) (int64, error) {
+	shift := 0
+	switch strings.ToLower(s[len(s)-min(len(s), 1):]) {
+	case "k":
+		shift = 10
+	case "m":
+		shift = 20
+	case "g":
+		shift = 30
+	}
+	if shift > 0 {
+		s = s[:len(s)-1]
+	}
+
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 || n > (1<<62)>>shift {
+		return 0, fmt.Errorf("bad size %q", s)
+	}
+	return n << shift, nil
+}
+
+func (f Filter) omitsTree(depth int) bool {
+	return f.LimitTrees && depth >= f.TreeDepth
+}
@@ -37,6 +37,11 @@ func Open(path string, ref string) (*GitRepo, error) {
 	return &g, nil
 }
 
+// Hash returns the commit the repository was opened at.
+func (g *GitRepo) Hash() string {
+	return g.h.String()
+}
+
 func (g *GitRepo) Commits() ([]*object.Commit, error) {
 	ci, err := g.r.Log(&git.LogOptions{From: g.h})
 	if err != nil {
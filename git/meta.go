@@ -0,0 +1,86 @@
+package git
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/go-git/go-git/v5/plumbing/format/config"
+)
+
+const defaultDescription = `Unnamed repository; edit this file 'description' to name the repository.`
+
+// Meta is what a repo says about itself, through its description file
+// and the gitweb and legit sections of its git config.
+type Meta struct {
+	Description string
+	// gitweb.owner, or legit.owner which takes precedence.
+	Owner    string
+	Section  string
+	Homepage string
+	// Tried before repo.mainBranch.
+	DefaultBranch string
+	// Hidden is nil unless legit.hidden is set, in which case it
+	// overrides the visibility of the repo's scan path.
+	Hidden *bool
+}
+
+// Dir returns the git directory of the repo at path, which is path itself
+// for bare repos.
+func Dir(path string) string {
+	if fi, err := os.Stat(filepath.Join(path, ".git")); err == nil && fi.IsDir() {
+		return filepath.Join(path, ".git")
+	}
+	return path
+}
+
+// ReadMeta reads the metadata of the repo at path. Anything missing or
+// unreadable is left empty.
+func ReadMeta(path string) Meta {
+	dir := Dir(path)
+
+	var m Meta
+	if data, err := os.ReadFile(filepath.Join(dir, "description")); err == nil {
+		m.Description = strings.TrimSpace(string(data))
+		if m.Description == defaultDescription {
+			m.Description = ""
+		}
+	}
+
+	f, err := os.Open(filepath.Join(dir, "config"))
+	if err != nil {
+		return m
+	}
+	defer f.Close()
+
+	cfg := config.New()
+	if err := config.NewDecoder(f).Decode(cfg); err != nil {
+		return m
+	}
+
+	gitweb, legit := cfg.Section("gitweb"), cfg.Section("legit")
+	m.Owner = gitweb.Option("owner")
+	if o := legit.Option("owner"); o != "" {
+		m.Owner = o
+	}
+	m.Section = legit.Option("section")
+	m.Homepage = legit.Option("homepage")
+	m.DefaultBranch = legit.Option("defaultBranch")
+	if legit.HasOption("hidden") {
+		hidden := parseBool(legit.Option("hidden"))
+		m.Hidden = &hidden
+	}
+
+	return m
+}
+
+// parseBool reads a boolean the way git does, where a key without a
+// value is true. Anything unrecognised is taken as true too, so that a
+// typo errs on the side of hiding.
+func parseBool(s string) bool {
+	switch strings.ToLower(s) {
+	case "false", "no", "off", "0":
+		return false
+	}
+	return true
+}
@@ -0,0 +1,504 @@
+package git
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/format/packfile"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+// Server answers fetches from a repository, for the parts of the git
+// protocol that go-git's own server doesn't cover.
+type Server struct {
+	r *git.Repository
+}
+
+func OpenServer(path string) (*Server, error) {
+	r, err := git.PlainOpen(path)
+	if err != nil {
+		return nil, fmt.Errorf("opening %s: %w", path, err)
+	}
+	return &Server{r: r}, nil
+}
+
+// Ref is an advertised ref. Target is set for symbolic refs, and Peeled
+// for annotated tags, to the object the tag ultimately points at. Hash
+// is zero for an unborn HEAD.
+type Ref struct {
+	Name   string
+	Hash   plumbing.Hash
+	Target string
+	Peeled plumbing.Hash
+}
+
+// Refs lists HEAD and every ref under refs/, HEAD first and the rest by
+// name.
+func (s *Server) Refs() ([]Ref, error) {
+	iter, err := s.r.References()
+	if err != nil {
+		return nil, fmt.Errorf("listing refs: %w", err)
+	}
+
+	var refs []Ref
+	err = iter.ForEach(func(ref *plumbing.Reference) error {
+		name := ref.Name().String()
+		if name != "HEAD" && !ref.Name().IsBranch() && !ref.Name().IsTag() &&
+			!ref.Name().IsRemote() && !ref.Name().IsNote() {
+			return nil
+		}
+
+		r := Ref{Name: name}
+		if ref.Type() == plumbing.SymbolicReference {
+			r.Target = ref.Target().String()
+			resolved, err := s.r.Reference(ref.Name(), true)
+			if errors.Is(err, plumbing.ErrReferenceNotFound) {
+				// Unborn, like HEAD in a fresh repo.
+				refs = append(refs, r)
+				return nil
+			} else if err != nil {
+				return err
+			}
+			ref = resolved
+		}
+
+		r.Hash = ref.Hash()
+		if tag, err := s.r.TagObject(r.Hash); err == nil {
+			r.Peeled = peel(tag)
+		}
+		refs = append(refs, r)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("listing refs: %w", err)
+	}
+
+	sort.Slice(refs, func(i, j int) bool {
+		if refs[i].Name == "HEAD" || refs[j].Name == "HEAD" {
+			return refs[i].Name == "HEAD"
+		}
+		return refs[i].Name < refs[j].Name
+	})
+	return refs, nil
+}
+
+// peel follows a chain of tags to the object at its end.
+func peel(tag *object.Tag) plumbing.Hash {
+	for tag.TargetType == plumbing.TagObject {
+		next, err := tag.Object()
+		if err != nil {
+			break
+		}
+		t, ok := next.(*object.Tag)
+		if !ok {
+			break
+		}
+		tag = t
+	}
+	return tag.Target
+}
+
+// Has reports whether the repository has object h.
+func (s *Server) Has(h plumbing.Hash) bool {
+	return s.r.Storer.HasEncodedObject(h) == nil
+}
+
+// PackRequest is what a client asked for in a fetch.
+type PackRequest struct {
+	Wants []plumbing.Hash
+	// Haves are the objects the client said it has that we have too.
+	Haves []plumbing.Hash
+	// Also send annotated tags that point at objects being sent.
+	IncludeTag bool
+
+	// Shallow are the client's shallow commits, past which it doesn't
+	// have any history.
+	Shallow []plumbing.Hash
+	// Deepen limits history to this many commits from the wants, or
+	// beyond the client's shallow commits with DeepenRelative.
+	Deepen         int
+	DeepenRelative bool
+	// DeepenSince leaves out commits older than this, and DeepenNot ones
+	// reachable from these revisions.
+	DeepenSince time.Time
+	DeepenNot   []string
+
+	Filter Filter
+}
+
+// Deepens reports whether req asks for a shallow pack.
+func (req PackRequest) Deepens() bool {
+	return req.Deepen > 0 || !req.DeepenSince.IsZero() || len(req.DeepenNot) > 0
+}
+
+// Pack is a packfile ready to be sent, along with the changes to the
+// client's shallow commits that go with it.
+type Pack struct {
+	s    *Server
+	objs []plumbing.Hash
+	// Commits the client is to treat as shallow, and those it no longer
+	// has to.
+	Shallow, Unshallow []plumbing.Hash
+}
+
+// PreparePack works out what to send for req: everything reachable from
+// the wants that the client doesn't have, minus what the request's
+// shallow options and filter leave out.
+func (s *Server) PreparePack(req PackRequest) (*Pack, error) {
+	for _, h := range req.Wants {
+		if !s.Has(h) {
+			return nil, fmt.Errorf("want %s: %w", h, plumbing.ErrObjectNotFound)
+		}
+	}
+
+	clientShallow := hashSet(req.Shallow)
+	p := &Pack{s: s}
+	w := newObjectWalk(s, req.Filter)
+
+	// Wants can be any kind of object; commits are walked below, the
+	// rest go in as is.
+	var commits []plumbing.Hash
+	for _, h := range req.Wants {
+		c, err := w.peel(h)
+		if err != nil {
+			return nil, err
+		}
+		if !c.IsZero() {
+			commits = append(commits, c)
+		}
+	}
+
+	var sent, known, edge, boundary map[plumbing.Hash]bool
+	var err error
+	if req.Deepens() {
+		sent, boundary, err = s.deepen(req, commits)
+		if err != nil {
+			return nil, err
+		}
+	}
+	switch {
+	case req.DeepenRelative && req.Deepen > 0:
+		// New history is sent in full, and what's old is deepened from
+		// where the client's history ends.
+		deeper := sent
+		sent, known, edge, err = s.newCommits(commits, req.Haves, clientShallow, nil)
+		if err != nil {
+			return nil, err
+		}
+		for h := range deeper {
+			sent[h] = true
+		}
+		// The client has its shallow commits, and they're where the
+		// deepened history picks up.
+		for h := range clientShallow {
+			if s.Has(h) {
+				known[h], edge[h] = true, true
+			}
+		}
+	case req.Deepens():
+		// How far back from the wants to go doesn't depend on the
+		// client's history, but what it has needn't be sent again.
+		_, known, edge, err = s.newCommits(commits, req.Haves, clientShallow, sent)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		sent, known, edge, err = s.newCommits(commits, req.Haves, clientShallow, nil)
+		if err != nil {
+			return nil, err
+		}
+	}
+	p.Shallow, p.Unshallow = shallowUpdate(req, sent, boundary)
+
+	// What's in the trees of the commits the client has next to the new
+	// ones, and of the ones it said it has, doesn't need sending again.
+	for _, h := range req.Haves {
+		edge[h] = true
+	}
+	if err := w.exclude(edge); err != nil {
+		return nil, err
+	}
+	for h := range sent {
+		if !known[h] {
+			if err := w.commit(h); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if req.IncludeTag {
+		if err := w.includeTags(); err != nil {
+			return nil, err
+		}
+	}
+
+	p.objs = w.objs
+	return p, nil
+}
+
+// ShallowUpdate works out the commits req makes shallow and unshallows,
+// as PreparePack does, without working out the rest of the pack.
+func (s *Server) ShallowUpdate(req PackRequest) (shallow, unshallow []plumbing.Hash, err error) {
+	if !req.Deepens() {
+		return nil, nil, nil
+	}
+
+	w := newObjectWalk(s, Filter{})
+	var commits []plumbing.Hash
+	for _, h := range req.Wants {
+		c, err := w.peel(h)
+		if err != nil {
+			return nil, nil, err
+		}
+		if !c.IsZero() {
+			commits = append(commits, c)
+		}
+	}
+
+	sent, boundary, err := s.deepen(req, commits)
+	if err != nil {
+		return nil, nil, err
+	}
+	shallow, unshallow = shallowUpdate(req, sent, boundary)
+	return shallow, unshallow, nil
+}
+
+// deepen walks the history a shallow request is for, from commits, the
+// wants, or from the client's shallow commits with DeepenRelative. It
+// returns the commits within it, and those on its boundary.
+func (s *Server) deepen(req PackRequest, commits []plumbing.Hash) (sent, boundary map[plumbing.Hash]bool, err error) {
+	if req.DeepenRelative && req.Deepen > 0 {
+		return s.walkFrom(req.Shallow, walkLimits{depth: req.Deepen + 1})
+	}
+	not, err := s.walkCommits(s.resolve(req.DeepenNot), walkLimits{})
+	if err != nil {
+		return nil, nil, err
+	}
+	return s.walkFrom(commits, walkLimits{depth: req.Deepen, since: req.DeepenSince, not: not})
+}
+
+// shallowUpdate returns the commits on the boundary of a shallow walk
+// that the client doesn't already have as shallow, and the client's
+// shallow commits that the walk went past.
+func shallowUpdate(req PackRequest, sent, boundary map[plumbing.Hash]bool) (shallow, unshallow []plumbing.Hash) {
+	clientShallow := hashSet(req.Shallow)
+	for h := range boundary {
+		if !clientShallow[h] {
+			shallow = append(shallow, h)
+		}
+	}
+	for _, h := range req.Shallow {
+		if sent[h] && !boundary[h] {
+			unshallow = append(unshallow, h)
+		}
+	}
+	return shallow, unshallow
+}
+
+// resolve resolves revisions for deepen-not, skipping those that don't
+// resolve, as git does.
+func (s *Server) resolve(revs []string) []plumbing.Hash {
+	var hashes []plumbing.Hash
+	for _, rev := range revs {
+		if h, err := s.r.ResolveRevision(plumbing.Revision(rev)); err == nil {
+			hashes = append(hashes, *h)
+		}
+	}
+	return hashes
+}
+
+// Encode writes the pack to w.
+func (p *Pack) Encode(w io.Writer) error {
+	if _, err := packfile.NewEncoder(w, p.s.r.Storer, false).Encode(p.objs, 10); err != nil {
+		return fmt.Errorf("encoding pack: %w", err)
+	}
+	return nil
+}
+
+// objectWalk collects the objects to pack, leaving out excluded ones and
+// whatever the filter says to.
+type objectWalk struct {
+	s      *Server
+	filter Filter
+	objs   []plumbing.Hash
+	added  map[plumbing.Hash]bool
+	// excluded are objects the client has.
+	excluded map[plumbing.Hash]bool
+	// The depth each tree was walked at, so that a tree left out by a
+	// tree depth filter is walked again if it turns up higher up.
+	trees map[plumbing.Hash]int
+}
+
+func newObjectWalk(s *Server, f Filter) *objectWalk {
+	return &objectWalk{
+		s:        s,
+		filter:   f,
+		added:    map[plumbing.Hash]bool{},
+		excluded: map[plumbing.Hash]bool{},
+		trees:    map[plumbing.Hash]int{},
+	}
+}
+
+func (w *objectWalk) add(h plumbing.Hash) {
+	if !w.added[h] && !w.excluded[h] {
+		w.added[h] = true
+		w.objs = append(w.objs, h)
+	}
+}
+
+// peel adds wanted object h and returns the commit it leads to, if any.
+// Objects that are asked for by name are sent whatever the filter says.
+func (w *objectWalk) peel(h plumbing.Hash) (plumbing.Hash, error) {
+	for {
+		obj, err := w.s.r.Storer.EncodedObject(plumbing.AnyObject, h)
+		if err != nil {
+			return plumbing.ZeroHash, fmt.Errorf("want %s: %w", h, err)
+		}
+
+		switch obj.Type() {
+		case plumbing.CommitObject:
+			return h, nil
+		case plumbing.TagObject:
+			w.add(h)
+			tag, err := object.DecodeTag(w.s.r.Storer, obj)
+			if err != nil {
+				return plumbing.ZeroHash, fmt.Errorf("want %s: %w", h, err)
+			}
+			h = tag.Target
+		case plumbing.TreeObject:
+			return plumbing.ZeroHash, w.tree(h, 0, Filter{})
+		default:
+			w.add(h)
+			return plumbing.ZeroHash, nil
+		}
+	}
+}
+
+// exclude marks the commits in has, and everything in their trees, as
+// already on the client.
+func (w *objectWalk) exclude(has map[plumbing.Hash]bool) error {
+	var mark func(h plumbing.Hash) error
+	mark = func(h plumbing.Hash) error {
+		if w.excluded[h] {
+			return nil
+		}
+		w.excluded[h] = true
+
+		t, err := object.GetTree(w.s.r.Storer, h)
+		if err != nil {
+			return fmt.Errorf("reading tree %s: %w", h, err)
+		}
+		for _, e := range t.Entries {
+			switch {
+			case e.Mode == filemode.Submodule:
+			case e.Mode == filemode.Dir:
+				if err := mark(e.Hash); err != nil {
+					return err
+				}
+			default:
+				w.excluded[e.Hash] = true
+			}
+		}
+		return nil
+	}
+
+	for h := range has {
+		c, err := object.GetCommit(w.s.r.Storer, h)
+		if err != nil {
+			return fmt.Errorf("reading commit %s: %w", h, err)
+		}
+		w.excluded[h] = true
+		if err := mark(c.TreeHash); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// commit adds commit h and its tree.
+func (w *objectWalk) commit(h plumbing.Hash) error {
+	c, err := object.GetCommit(w.s.r.Storer, h)
+	if err != nil {
+		return fmt.Errorf("reading commit %s: %w", h, err)
+	}
+	w.add(h)
+	return w.tree(c.TreeHash, 0, w.filter)
+}
+
+// tree adds tree h, found depth levels below a root tree, and what's in
+// it, as far as f allows.
+func (w *objectWalk) tree(h plumbing.Hash, depth int, f Filter) error {
+	if f.omitsTree(depth) || w.excluded[h] {
+		return nil
+	}
+	if d, ok := w.trees[h]; ok && d <= depth {
+		return nil
+	}
+	w.trees[h] = depth
+
+	t, err := object.GetTree(w.s.r.Storer, h)
+	if err != nil {
+		return fmt.Errorf("reading tree %s: %w", h, err)
+	}
+	w.add(h)
+
+	for _, e := range t.Entries {
+		switch e.Mode {
+		case filemode.Submodule:
+			// Commits in other repositories.
+		case filemode.Dir:
+			if err := w.tree(e.Hash, depth+1, f); err != nil {
+				return err
+			}
+		default:
+			if w.added[e.Hash] || w.excluded[e.Hash] || f.omitsTree(depth+1) {
+				continue
+			}
+			if f.LimitBlobs && f.BlobLimit == 0 {
+				continue
+			} else if f.LimitBlobs {
+				size, err := w.s.r.Storer.EncodedObjectSize(e.Hash)
+				if err != nil {
+					return fmt.Errorf("reading blob %s: %w", e.Hash, err)
+				}
+				if size >= f.BlobLimit {
+					continue
+				}
+			}
+			w.add(e.Hash)
+		}
+	}
+	return nil
+}
+
+// includeTags adds the annotated tags pointing at objects being sent.
+func (w *objectWalk) includeTags() error {
+	tags, err := w.s.r.TagObjects()
+	if err != nil {
+		return fmt.Errorf("listing tags: %w", err)
+	}
+	err = tags.ForEach(func(t *object.Tag) error {
+		if w.added[t.Target] {
+			w.add(t.Hash)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("listing tags: %w", err)
+	}
+	return nil
+}
+
+func hashSet(hashes []plumbing.Hash) map[plumbing.Hash]bool {
+	set := make(map[plumbing.Hash]bool, len(hashes))
+	for _, h := range hashes {
+		set[h] = true
+	}
+	return set
+}
@@ -0,0 +1,67 @@
+package git
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+// Pushed lists the commits an update of ref from old to new brought in,
+// newest first: those reachable from new but not from old, or, for a
+// ref that's new, not from any other branch.
+func (s *Server) Pushed(ref string, old, new plumbing.Hash) ([]*object.Commit, error) {
+	new, ok := s.commitOf(new)
+	if !ok {
+		return nil, nil
+	}
+
+	var known []plumbing.Hash
+	if old, ok := s.commitOf(old); ok {
+		known = append(known, old)
+	} else {
+		refs, err := s.Refs()
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range refs {
+			if r.Name != ref && plumbing.ReferenceName(r.Name).IsBranch() {
+				known = append(known, r.Hash)
+			}
+		}
+	}
+
+	// Walked side by side, as for a fetch, so that a push costs about
+	// as much as what it brought in.
+	pushed, _, _, err := s.newCommits([]plumbing.Hash{new}, known, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	commits := make([]*object.Commit, 0, len(pushed))
+	for h := range pushed {
+		c, err := object.GetCommit(s.r.Storer, h)
+		if err != nil {
+			return nil, fmt.Errorf("reading commit %s: %w", h, err)
+		}
+		commits = append(commits, c)
+	}
+	sort.Slice(commits, func(i, j int) bool {
+		return commits[i].Committer.When.After(commits[j].Committer.When)
+	})
+	return commits, nil
+}
+
+// commitOf peels h, which tags can point at, to a commit, and reports
+// whether there was one.
+func (s *Server) commitOf(h plumbing.Hash) (plumbing.Hash, bool) {
+	if h.IsZero() {
+		return h, false
+	}
+	if tag, err := s.r.TagObject(h); err == nil {
+		h = peel(tag)
+	}
+	_, err := object.GetCommit(s.r.Storer, h)
+	return h, err == nil
+}
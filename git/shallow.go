@@ -0,0 +1,218 @@
+package git
+
+import (
+	"container/heap"
+	"fmt"
+	"time"
+
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+// walkLimits bounds a walk through commit history.
+type walkLimits struct {
+	// Commits the walk doesn't go past, but does include.
+	shallow map[plumbing.Hash]bool
+
+	// How many commits deep to go from where the walk starts, if not 0;
+	// commits older than since; and commits in not. Commits with a parent
+	// left out for one of these end up on the boundary.
+	depth int
+	since time.Time
+	not   map[plumbing.Hash]bool
+}
+
+// walkCommits returns the commits reachable from starts, within l.
+func (s *Server) walkCommits(starts []plumbing.Hash, l walkLimits) (map[plumbing.Hash]bool, error) {
+	seen, _, err := s.walkFrom(starts, l)
+	return seen, err
+}
+
+// walkFrom walks the history of starts breadth first, so each commit is
+// seen at its shortest distance from them. It returns the commits within
+// l, and of those, the ones that would be shallow in a clone of them.
+func (s *Server) walkFrom(starts []plumbing.Hash, l walkLimits) (seen, boundary map[plumbing.Hash]bool, err error) {
+	type item struct {
+		c     *object.Commit
+		depth int
+	}
+
+	seen = map[plumbing.Hash]bool{}
+	boundary = map[plumbing.Hash]bool{}
+	var queue []item
+	for _, h := range starts {
+		if seen[h] {
+			continue
+		}
+		c, err := object.GetCommit(s.r.Storer, h)
+		if err != nil {
+			return nil, nil, fmt.Errorf("reading commit %s: %w", h, err)
+		}
+		seen[h] = true
+		queue = append(queue, item{c, 1})
+	}
+
+	for len(queue) > 0 {
+		it := queue[0]
+		queue = queue[1:]
+		if l.shallow[it.c.Hash] {
+			continue
+		}
+
+		for _, p := range it.c.ParentHashes {
+			if l.depth > 0 && it.depth >= l.depth || l.not[p] {
+				boundary[it.c.Hash] = true
+				continue
+			}
+			if seen[p] {
+				continue
+			}
+
+			parent, err := object.GetCommit(s.r.Storer, p)
+			if err != nil {
+				return nil, nil, fmt.Errorf("reading commit %s: %w", p, err)
+			}
+			if !l.since.IsZero() && parent.Committer.When.Before(l.since) {
+				boundary[it.c.Hash] = true
+				continue
+			}
+			seen[p] = true
+			queue = append(queue, item{parent, it.depth + 1})
+		}
+	}
+	return seen, boundary, nil
+}
+
+// How many more commits newCommits looks at once only ones the client
+// has are left, in case of clock skew, as in git rev-list.
+const slop = 5
+
+// newCommits returns the commits reachable from wants but not from
+// haves, going no further back than the client's shallow commits on the
+// haves' side, and only through commits in within if it isn't nil. Like
+// git rev-list, it walks both sides together, newest first, and stops
+// once only commits the client has are left, so it costs about as much
+// as the history being sent rather than all of it.
+//
+// known are the commits it found the client has, and edge those of them
+// that are parents of commits being sent, whose trees are likely to have
+// most of what's in the new ones.
+func (s *Server) newCommits(wants, haves []plumbing.Hash, shallow, within map[plumbing.Hash]bool) (sent, known, edge map[plumbing.Hash]bool, err error) {
+	seen := map[plumbing.Hash]*object.Commit{}
+	known = map[plumbing.Hash]bool{}
+	queue := &commitQueue{}
+
+	// markKnown marks h, and what's been seen of its history, as on the
+	// client.
+	markKnown := func(h plumbing.Hash) {
+		stack := []plumbing.Hash{h}
+		for len(stack) > 0 {
+			h := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			if known[h] {
+				continue
+			}
+			known[h] = true
+			if c := seen[h]; c != nil && !shallow[h] {
+				stack = append(stack, c.ParentHashes...)
+			}
+		}
+	}
+	push := func(h plumbing.Hash, isKnown bool) error {
+		if _, ok := seen[h]; ok {
+			if isKnown {
+				markKnown(h)
+			}
+			return nil
+		}
+		if !isKnown && within != nil && !within[h] {
+			return nil
+		}
+		c, err := object.GetCommit(s.r.Storer, h)
+		if err != nil {
+			return fmt.Errorf("reading commit %s: %w", h, err)
+		}
+		seen[h] = c
+		if isKnown {
+			known[h] = true
+		}
+		heap.Push(queue, c)
+		return nil
+	}
+
+	for _, h := range haves {
+		if err := push(h, true); err != nil {
+			return nil, nil, nil, err
+		}
+	}
+	for _, h := range wants {
+		if err := push(h, false); err != nil {
+			return nil, nil, nil, err
+		}
+	}
+
+	var order []plumbing.Hash
+	for left := slop; queue.Len() > 0; {
+		if queue.allKnown(known) {
+			if left == 0 {
+				break
+			}
+			left--
+		}
+
+		c := heap.Pop(queue).(*object.Commit)
+		isKnown := known[c.Hash]
+		if !isKnown {
+			order = append(order, c.Hash)
+		} else if shallow[c.Hash] {
+			// The client doesn't have what's behind it.
+			continue
+		}
+		for _, p := range c.ParentHashes {
+			if err := push(p, isKnown); err != nil {
+				return nil, nil, nil, err
+			}
+		}
+	}
+
+	// Commits can turn out to be known after they've been walked.
+	sent = map[plumbing.Hash]bool{}
+	edge = map[plumbing.Hash]bool{}
+	for _, h := range order {
+		if known[h] {
+			continue
+		}
+		sent[h] = true
+		for _, p := range seen[h].ParentHashes {
+			if known[p] {
+				edge[p] = true
+			}
+		}
+	}
+	return sent, known, edge, nil
+}
+
+// commitQueue is a heap of commits, newest first.
+type commitQueue []*object.Commit
+
+func (q commitQueue) Len() int { return len(q) }
+func (q commitQueue) Less(i, j int) bool {
+	return q[i].Committer.When.After(q[j].Committer.When)
+}
+func (q commitQueue) Swap(i, j int) { q[i], q[j] = q[j], q[i] }
+func (q *commitQueue) Push(x any)   { *q = append(*q, x.(*object.Commit)) }
+func (q *commitQueue) Pop() any {
+	old := *q
+	c := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return c
+}
+
+func (q commitQueue) allKnown(known map[plumbing.Hash]bool) bool {
+	for _, c := range q {
+		if !known[c.Hash] {
+			return false
+		}
+	}
+	return true
+}
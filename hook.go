@@ -0,0 +1,135 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+
+	"git.icyphox.sh/legit/config"
+	"git.icyphox.sh/legit/git"
+	"git.icyphox.sh/legit/webhook"
+)
+
+// hook implements 'legit hook post-receive', which git runs as a repo's
+// post-receive hook. It queues a webhook delivery for every ref update
+// and webhook the repo has, for the server to send.
+func hook(args []string) {
+	if len(args) == 0 || args[0] != "post-receive" {
+		fmt.Fprintln(os.Stderr, "usage: legit hook post-receive [flags]")
+		os.Exit(2)
+	}
+
+	fs := flag.NewFlagSet("hook post-receive", flag.ExitOnError)
+	src := configFlags(fs)
+	fs.Parse(args[1:])
+
+	if err := postReceive(src); err != nil {
+		fmt.Fprintln(os.Stderr, "legit:", err)
+		os.Exit(1)
+	}
+}
+
+func postReceive(src *configSource) error {
+	c, err := src.load()
+	if err != nil {
+		return err
+	}
+	updates, err := webhook.ParseUpdates(os.Stdin)
+	if err != nil {
+		return err
+	}
+	if len(c.Hooks.Webhooks) == 0 || len(updates) == 0 {
+		return nil
+	}
+
+	// Hooks run in the git directory, with GIT_DIR set.
+	dir := os.Getenv("GIT_DIR")
+	if dir == "" {
+		dir = "."
+	}
+	name, ok := hookRepoName(c, dir)
+	if !ok {
+		return fmt.Errorf("%s isn't a repo in any of repo.scanPath", dir)
+	}
+
+	srv, err := git.OpenServer(dir)
+	if err != nil {
+		return err
+	}
+	q, err := webhook.OpenQueue(c.Hooks.Queue)
+	if err != nil {
+		return err
+	}
+
+	base := ""
+	if c.Server.Name != "" {
+		base = "https://" + c.Server.Name + c.Server.BasePath
+	}
+	for _, u := range updates {
+		p, err := webhook.NewPush(srv, name, u, pusher(), base)
+		if err != nil {
+			return fmt.Errorf("%s: %w", u.Ref, err)
+		}
+		ds, err := webhook.Deliveries(c.Hooks.Webhooks, p)
+		if err != nil {
+			return err
+		}
+		for _, d := range ds {
+			if err := q.Add(d); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// hookRepoName works out the name legit serves the repo in dir under,
+// from the scan path it's in.
+func hookRepoName(c *config.Config, dir string) (string, bool) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", false
+	}
+	if d, err := filepath.EvalSymlinks(dir); err == nil {
+		dir = d
+	}
+	// Non-bare repos are served under the name of their work tree.
+	if filepath.Base(dir) == ".git" {
+		dir = filepath.Dir(dir)
+	}
+
+	for _, sp := range c.Repo.ScanPath {
+		root, err := filepath.Abs(sp.Path)
+		if err != nil {
+			continue
+		}
+		if r, err := filepath.EvalSymlinks(root); err == nil {
+			root = r
+		}
+
+		rel, err := filepath.Rel(root, dir)
+		if err != nil || rel == "." || strings.HasPrefix(rel, "..") || strings.ContainsRune(rel, filepath.Separator) {
+			continue
+		}
+		if sp.Prefix != "" {
+			return sp.Prefix + "/" + rel, true
+		}
+		return rel, true
+	}
+	return "", false
+}
+
+// pusher names whoever pushed: the user gitolite says it is, or else
+// the user the hook runs as.
+func pusher() string {
+	if u := os.Getenv("GL_USER"); u != "" {
+		return u
+	}
+	if u, err := user.Current(); err == nil {
+		return u.Username
+	}
+	return ""
+}
@@ -1,36 +1,285 @@
 package main
 
 import (
+	"context"
+	"crypto/x509"
+	"embed"
+	"errors"
 	"flag"
-	"fmt"
-	"log"
+	"log/slog"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"slices"
+	"syscall"
 
 	"git.icyphox.sh/legit/config"
+	"git.icyphox.sh/legit/logging"
 	"git.icyphox.sh/legit/routes"
+	"git.icyphox.sh/legit/webhook"
 )
 
+// Default templates and static assets, overridable per file through
+// dirs.templates and dirs.static.
+//
+//go:embed templates static
+var assets embed.FS
+
+// resolverFiles are what looking up a host name reads.
+var resolverFiles = []string{"/etc/hosts", "/etc/resolv.conf", "/etc/nsswitch.conf"}
+
+// errNoSandbox is returned by UnveilBlock where filesystem access can't be
+// restricted. That's only fatal with sandbox.require set.
+var errNoSandbox = errors.New("sandboxing not supported")
+
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
 func main() {
-	var cfg string
-	flag.StringVar(&cfg, "config", "./config.yaml", "path to config file")
+	args := os.Args[1:]
+	if len(args) > 0 {
+		switch args[0] {
+		case "check":
+			check(args[1:])
+			return
+		case "config":
+			configDump(args[1:])
+			return
+		case "hook":
+			hook(args[1:])
+			return
+		}
+	}
+
+	src := configFlags(flag.CommandLine)
 	flag.Parse()
 
-	c, err := config.Read(cfg)
+	c, err := src.load()
 	if err != nil {
-		log.Fatal(err)
+		fatal("reading config", "err", err)
 	}
+	if err := errors.Join(c.Validate(), routes.CheckTemplates(c, assets)); err != nil {
+		fatal("invalid config", "err", err)
+	}
+
+	logger, err := logging.New(c.Log.Level, c.Log.Format, c.Log.Output)
+	if err != nil {
+		fatal("setting up logging", "err", err)
+	}
+	slog.SetDefault(logger)
 
-	if err := UnveilPaths([]string{
-		c.Dirs.Static,
-		c.Repo.ScanPath,
-		c.Dirs.Templates,
-	},
-		"r"); err != nil {
-		log.Fatalf("unveil: %s", err)
+	// The config file is read again on SIGHUP.
+	paths := []string{}
+	for _, sp := range c.Repo.ScanPath {
+		paths = append(paths, sp.Path)
 	}
+	for _, dir := range []string{src.file(), c.Dirs.Static, c.Dirs.Templates, c.Server.TLS.Cert, c.Server.TLS.Key} {
+		if dir != "" {
+			paths = append(paths, dir)
+		}
+	}
+
+	router := routes.Handlers(c, assets)
+
+	var queue *webhook.Queue
+	if c.Hooks.Queue != "" {
+		queue, err = webhook.OpenQueue(c.Hooks.Queue)
+		if err != nil {
+			fatal("setting up webhooks", "err", err)
+		}
+		router.Webhooks(queue)
+	}
+
+	srv, err := newServer(c, router)
+	if err != nil {
+		fatal("setting up server", "err", err)
+	}
+
+	var daemon *routes.Daemon
+	if c.Daemon.Addr != "" {
+		ln, err := net.Listen("tcp", c.Daemon.Addr)
+		if err != nil {
+			fatal("setting up git daemon", "err", err)
+		}
+		daemon = router.Daemon(ln)
+	}
+
+	// The log file is opened again when the config's reloaded.
+	if out := c.Log.Output; out != "" && out != "stderr" && out != "stdout" {
+		if err := Unveil(out, "w"); err != nil {
+			fatal("unveil", "err", err)
+		}
+	}
+
+	// The socket needs to go away on shutdown.
+	if c.Server.Socket != "" {
+		if err := Unveil(c.Server.Socket, "rwc"); err != nil {
+			fatal("unveil", "err", err)
+		}
+	}
+
+	// The post-receive hook queues webhook deliveries here, and legit
+	// sends them and moves them to the log. Sending them takes looking
+	// up hosts, which reads the resolver's files as they change, and
+	// checking certificates, whose roots are loaded once, so now.
+	if c.Hooks.Queue != "" {
+		if err := Unveil(c.Hooks.Queue, "rwc"); err != nil {
+			fatal("unveil", "err", err)
+		}
+		for _, path := range resolverFiles {
+			if err := Unveil(path, "r"); err != nil {
+				fatal("unveil", "err", err)
+			}
+		}
+		if _, err := x509.SystemCertPool(); err != nil {
+			slog.Warn("webhooks: loading CA certificates", "err", err)
+		}
+	}
+
+	err = UnveilPaths(paths, "r")
+	if errors.Is(err, errNoSandbox) && !c.Sandbox.Require {
+		slog.Warn("unveil: running without a sandbox", "err", err)
+	} else if err != nil {
+		fatal("unveil", "err", err)
+	}
+	sandboxed := err == nil
+
+	var metrics *http.Server
+	if c.Metrics.Addr != "" {
+		mm := http.NewServeMux()
+		mm.Handle("/metrics", routes.MetricsHandler())
+		metrics = &http.Server{
+			Addr:              c.Metrics.Addr,
+			Handler:           mm,
+			ReadHeaderTimeout: c.Server.ReadTimeout,
+		}
+		go func() {
+			slog.Info("serving metrics", "addr", c.Metrics.Addr)
+			if err := metrics.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				fatal("metrics server", "err", err)
+			}
+		}()
+	}
+
+	if daemon != nil {
+		go func() {
+			if err := daemon.Serve(); err != nil {
+				fatal("git daemon", "err", err)
+			}
+		}()
+	}
+
+	hooks, stopHooks := context.WithCancel(context.Background())
+	defer stopHooks()
+	if queue != nil {
+		go webhook.Run(hooks, queue, c.Hooks.Attempts)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- srv.serve()
+	}()
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM)
+
+	for {
+		select {
+		case err := <-done:
+			if err != nil {
+				fatal("server", "err", err)
+			}
+			return
+		case sig := <-sigs:
+			if sig == syscall.SIGHUP {
+				c = reload(src, c, router, sandboxed)
+				srv.reloadCerts()
+				continue
+			}
+
+			slog.Info("shutting down", "signal", sig.String(), "timeout", c.Server.ShutdownTimeout)
+			stopHooks()
+			ctx, cancel := context.WithTimeout(context.Background(), c.Server.ShutdownTimeout)
+			if metrics != nil {
+				metrics.Shutdown(ctx)
+			}
+			if daemon != nil {
+				daemon.Shutdown(ctx)
+			}
+			err := srv.shutdown(ctx)
+			cancel()
+			if err != nil {
+				fatal("shutting down", "err", err)
+			}
+			<-done
+			return
+		}
+	}
+}
+
+// reload re-reads the config and switches the router over to it. If the
+// new config doesn't load or validate, the current one stays in place.
+// In the sandbox, paths other than those unveiled at startup can't be
+// read, so scan paths, dirs and the log output are kept as they are.
+func reload(src *configSource, cur *config.Config, router *routes.Router, sandboxed bool) *config.Config {
+	c, err := src.load()
+	if err == nil {
+		err = errors.Join(c.Validate(), routes.CheckTemplates(c, assets))
+	}
+	if err != nil {
+		slog.Error("reloading config, keeping the current one", "err", err)
+		return cur
+	}
+
+	if sandboxed && (!sameScanPaths(c.Repo.ScanPath, cur.Repo.ScanPath) ||
+		c.Dirs != cur.Dirs ||
+		c.Log.Output != cur.Log.Output) {
+		slog.Warn("reloading config: scan paths, dirs and log.output only change on restart in the sandbox")
+		if !sameScanPaths(c.Repo.ScanPath, cur.Repo.ScanPath) {
+			c.Repo.ScanPath = cur.Repo.ScanPath
+		}
+		c.Dirs = cur.Dirs
+		c.Log.Output = cur.Log.Output
+	}
+
+	if c.Log != cur.Log {
+		logger, err := logging.New(c.Log.Level, c.Log.Format, c.Log.Output)
+		if err != nil {
+			slog.Error("reloading config: setting up logging", "err", err)
+		} else {
+			slog.SetDefault(logger)
+		}
+	}
+
+	// Listeners are set up once; these need a restart.
+	if c.Server.Host != cur.Server.Host ||
+		c.Server.Port != cur.Server.Port ||
+		c.Server.Socket != cur.Server.Socket ||
+		c.Server.TLS != cur.Server.TLS ||
+		c.Server.ReadTimeout != cur.Server.ReadTimeout ||
+		c.Server.WriteTimeout != cur.Server.WriteTimeout ||
+		c.Server.IdleTimeout != cur.Server.IdleTimeout ||
+		c.Metrics != cur.Metrics ||
+		c.Daemon != cur.Daemon ||
+		c.Hooks.Queue != cur.Hooks.Queue ||
+		c.Hooks.Attempts != cur.Hooks.Attempts ||
+		c.Sandbox != cur.Sandbox {
+		slog.Warn("reloading config: listener, timeout, tls, metrics, daemon, webhook queue and sandbox settings only change on restart")
+	}
+
+	router.Reload(c)
+	slog.Info("reloaded config")
+
+	return c
+}
 
-	mux := routes.Handlers(c)
-	addr := fmt.Sprintf("%s:%d", c.Server.Host, c.Server.Port)
-	log.Println("starting server on", addr)
-	log.Fatal(http.ListenAndServe(addr, mux))
+// sameScanPaths reports whether a and b are in the same directories,
+// whatever their prefixes and visibility.
+func sameScanPaths(a, b config.ScanPaths) bool {
+	return slices.EqualFunc(a, b, func(x, y config.ScanPath) bool {
+		return x.Path == y.Path
+	})
 }
@@ -0,0 +1,124 @@
+package routes
+
+import (
+	"errors"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"git.icyphox.sh/legit/config"
+)
+
+// overlayFS serves files from dir when they exist there, falling back
+// to the embedded defaults otherwise.
+type overlayFS struct {
+	dir   string
+	lower fs.FS
+}
+
+func (o overlayFS) Open(name string) (fs.File, error) {
+	if o.dir != "" {
+		f, err := os.DirFS(o.dir).Open(name)
+		if err == nil {
+			return f, nil
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
+	}
+
+	return o.lower.Open(name)
+}
+
+// requiredTemplates are the templates the handlers render, directly or
+// through other templates.
+var requiredTemplates = []string{
+	"index", "repo", "tree", "file", "log", "commit", "refs",
+	"webhooks", "404", "500", "head", "nav", "repoheader",
+}
+
+// CheckTemplates parses the templates legit would use with c and reports
+// whether any fail to parse or are missing.
+func CheckTemplates(c *config.Config, assets fs.FS) error {
+	d := &deps{assets: assets}
+	d.cfg.Store(c)
+	t, err := d.templates()
+	if err != nil {
+		return fmt.Errorf("templates: %w", err)
+	}
+
+	var errs []error
+	for _, name := range requiredTemplates {
+		if t.Lookup(name) == nil {
+			errs = append(errs, fmt.Errorf("templates: %q is not defined", name))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// templates parses the embedded templates, then any templates found in
+// dirs.templates on top of them. Since every file defines its templates
+// by name, a single file in the configured dir overrides just the
+// templates it defines.
+func (d *deps) templates() (*template.Template, error) {
+	embedded, err := fs.Sub(d.assets, "templates")
+	if err != nil {
+		return nil, err
+	}
+
+	t, err := template.New("legit").Funcs(d.funcs()).ParseFS(embedded, "*.html")
+	if err != nil {
+		return nil, err
+	}
+
+	if d.c().Dirs.Templates == "" {
+		return t, nil
+	}
+
+	tpath := filepath.Join(d.c().Dirs.Templates, "*")
+	matches, err := filepath.Glob(tpath)
+	if err != nil || len(matches) == 0 {
+		return t, err
+	}
+
+	return t.ParseFiles(matches...)
+}
+
+func (d *deps) funcs() template.FuncMap {
+	return template.FuncMap{
+		"url":   d.url,
+		"fonts": d.fonts,
+	}
+}
+
+// url builds an absolute link under server.basePath out of path
+// segments, skipping empty ones; {{ url }} alone links to the index.
+func (d *deps) url(parts ...any) string {
+	segs := []string{d.c().Server.BasePath}
+	for _, p := range parts {
+		if s := fmt.Sprint(p); s != "" {
+			segs = append(segs, s)
+		}
+	}
+
+	u := strings.Join(segs, "/")
+	if len(segs) == 1 {
+		u += "/"
+	}
+	return u
+}
+
+// static returns the static assets, with files in dirs.static taking
+// precedence over the embedded ones.
+func (d *deps) static() fs.FS {
+	embedded, err := fs.Sub(d.assets, "static")
+	if err != nil {
+		embedded = d.assets
+	}
+
+	return overlayFS{dir: d.c().Dirs.Static, lower: embedded}
+}
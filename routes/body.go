@@ -0,0 +1,83 @@
+package routes
+
+import (
+	"bufio"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// errUnsupportedEncoding is returned by gitBody for Content-Encodings
+// other than gzip.
+var errUnsupportedEncoding = errors.New("unsupported content encoding")
+
+// gitBody returns the body of a request from a git client. git gzips
+// big requests, and the body is decompressed if so. It's cut off at
+// limits.requestBody bytes, both as sent and decompressed, so that a
+// small request can't inflate into a huge one.
+//
+// Chunked bodies, which git sends for requests bigger than its
+// http.postBuffer, are taken care of by net/http.
+func (d *deps) gitBody(w http.ResponseWriter, r *http.Request) (*bufio.Reader, error) {
+	limit := d.c().Limits.RequestBody
+	body := r.Body
+	if limit > 0 {
+		body = http.MaxBytesReader(w, body, limit)
+	}
+
+	switch enc := strings.ToLower(r.Header.Get("Content-Encoding")); enc {
+	case "", "identity":
+	case "gzip", "x-gzip":
+		zr, err := gzip.NewReader(body)
+		if err != nil {
+			return nil, fmt.Errorf("decompressing request: %w", err)
+		}
+		body = zr
+		if limit > 0 {
+			body = http.MaxBytesReader(w, zr, limit)
+		}
+	default:
+		return nil, fmt.Errorf("%w %q", errUnsupportedEncoding, enc)
+	}
+	return bufio.NewReader(body), nil
+}
+
+// bodyStatus is the status to answer with when reading a request body
+// fails with err.
+func bodyStatus(err error) int {
+	var tooBig *http.MaxBytesError
+	switch {
+	case errors.As(err, &tooBig):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, errUnsupportedEncoding):
+		return http.StatusUnsupportedMediaType
+	}
+	return http.StatusBadRequest
+}
+
+// isProbe reports whether body is just a flush packet. Before sending a
+// request too big to buffer, git checks that the server is there (and
+// lets it ask for credentials) with one of these, and wants a 200 back.
+func isProbe(body *bufio.Reader) bool {
+	b, err := body.Peek(5)
+	return string(b) == "0000" && errors.Is(err, io.EOF)
+}
+
+// bodyErrReader remembers the first error reading r, other than io.EOF,
+// to tell a request body that couldn't be read from one that could but
+// made no sense.
+type bodyErrReader struct {
+	r   io.Reader
+	err error
+}
+
+func (br *bodyErrReader) Read(p []byte) (int, error) {
+	n, err := br.r.Read(p)
+	if err != nil && err != io.EOF && br.err == nil {
+		br.err = err
+	}
+	return n, err
+}
@@ -0,0 +1,129 @@
+package routes
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"git.icyphox.sh/legit/git"
+)
+
+// Pages addressed by a full commit hash never change, so clients and
+// proxies may keep them for as long as they like.
+const immutableCacheControl = "public, max-age=31536000, immutable"
+
+// notModified sets the ETag and Cache-Control headers for a page rendered
+// from the commit hash that ref resolved to, and reports whether the
+// client's copy is still current. If it is, a 304 has been written and
+// the caller should stop there.
+func (d *deps) notModified(w http.ResponseWriter, r *http.Request, ref, hash string, meta git.Meta) bool {
+	tag := d.etag(r.URL.Path, hash, meta.Description, meta.Owner, meta.Homepage)
+
+	w.Header().Set("ETag", tag)
+	if ref == hash {
+		w.Header().Set("Cache-Control", immutableCacheControl)
+	} else {
+		// Branch-addressed pages can move at any time; caches may keep
+		// them but must revalidate.
+		w.Header().Set("Cache-Control", "no-cache")
+	}
+
+	match := etagMatch(r.Header.Get("If-None-Match"), tag)
+	cacheResult("etag", match)
+	if match {
+		w.WriteHeader(http.StatusNotModified)
+	}
+
+	return match
+}
+
+// clearCacheHeaders drops caching headers set by notModified, so that
+// an error page for a commit-addressed URL isn't cached forever.
+func clearCacheHeaders(w http.ResponseWriter) {
+	w.Header().Del("ETag")
+	w.Header().Del("Cache-Control")
+}
+
+// etag derives a strong ETag from everything that goes into a rendered
+// page: the URL, the commit, the templates and the bits of config and
+// repo metadata shown around it.
+func (d *deps) etag(parts ...string) string {
+	h := sha256.New()
+	for _, p := range parts {
+		fmt.Fprintf(h, "%s\x00", p)
+	}
+	fmt.Fprintf(h, "%+v\x00%s\x00", d.c().Meta, d.c().Server.Name)
+	fmt.Fprintf(h, "%s\x00%s", embeddedVersion(d.assets), templatesVersion(d.c().Dirs.Templates))
+
+	return `"` + hex.EncodeToString(h.Sum(nil)[:16]) + `"`
+}
+
+// etagMatch implements the weak comparison If-None-Match calls for.
+func etagMatch(header, tag string) bool {
+	if header == "" {
+		return false
+	}
+
+	for _, t := range strings.Split(header, ",") {
+		t = strings.TrimSpace(t)
+		if t == "*" || strings.TrimPrefix(t, "W/") == tag {
+			return true
+		}
+	}
+
+	return false
+}
+
+var (
+	embeddedOnce sync.Once
+	embeddedSum  string
+)
+
+// embeddedVersion hashes the embedded templates. They can't change while
+// we're running, so this is only done once.
+func embeddedVersion(assets fs.FS) string {
+	embeddedOnce.Do(func() {
+		h := sha256.New()
+		fs.WalkDir(assets, "templates", func(path string, e fs.DirEntry, err error) error {
+			if err != nil || e.IsDir() {
+				return err
+			}
+			b, err := fs.ReadFile(assets, path)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(h, "%s\x00%s\x00", path, b)
+			return nil
+		})
+		embeddedSum = hex.EncodeToString(h.Sum(nil))
+	})
+
+	return embeddedSum
+}
+
+// templatesVersion fingerprints the templates overriding the embedded
+// ones, which may be edited while we're running.
+func templatesVersion(dir string) string {
+	if dir == "" {
+		return ""
+	}
+
+	matches, _ := filepath.Glob(filepath.Join(dir, "*"))
+
+	var b strings.Builder
+	for _, m := range matches {
+		fi, err := os.Stat(m)
+		if err != nil {
+			continue
+		}
+		fmt.Fprintf(&b, "%s:%d:%d;", m, fi.Size(), fi.ModTime().UnixNano())
+	}
+
+	return b.String()
+}
@@ -0,0 +1,236 @@
+package routes
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"git.icyphox.sh/legit/config"
+)
+
+// runGit runs git in dir, with no config but what the test sets up, and
+// returns what it printed.
+func runGit(t *testing.T, dir string, args ...string) string {
+	t.Helper()
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(),
+		"GIT_CONFIG_GLOBAL=/dev/null",
+		"GIT_CONFIG_NOSYSTEM=1",
+		"GIT_AUTHOR_NAME=legit", "GIT_AUTHOR_EMAIL=legit@example.com",
+		"GIT_COMMITTER_NAME=legit", "GIT_COMMITTER_EMAIL=legit@example.com",
+		"GIT_TERMINAL_PROMPT=0",
+	)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("git %s: %v\n%s", strings.Join(args, " "), err, out)
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// commitDay commits what's in work as of day days into 2020.
+func commitDay(t *testing.T, work string, day int, msg string) {
+	t.Helper()
+	date := fmt.Sprintf("2020-01-%02dT12:00:00Z", day)
+	t.Setenv("GIT_AUTHOR_DATE", date)
+	t.Setenv("GIT_COMMITTER_DATE", date)
+	runGit(t, work, "add", "-A")
+	runGit(t, work, "commit", "-q", "-m", msg)
+}
+
+// cloneFixture makes a repo with a commit a day for six days, each
+// changing a small file, a big one and one a few trees down, and serves
+// it over HTTP and git://.
+func cloneFixture(t *testing.T) (work string, urls map[string]string) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git isn't installed")
+	}
+
+	root := t.TempDir()
+	repos := filepath.Join(root, "repos")
+	work = filepath.Join(root, "work")
+	runGit(t, root, "init", "-q", "-b", "master", work)
+	if err := os.MkdirAll(filepath.Join(work, "a", "b"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	for day := 1; day <= 6; day++ {
+		files := map[string]string{
+			"small.txt":   fmt.Sprintf("day %d\n", day),
+			"big.bin":     strings.Repeat(strconv.Itoa(day), 4096),
+			"a/b/deep.md": fmt.Sprintf("deep %d\n", day),
+		}
+		for name, data := range files {
+			if err := os.WriteFile(filepath.Join(work, name), []byte(data), 0o644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		commitDay(t, work, day, fmt.Sprintf("day %d", day))
+	}
+	runGit(t, root, "clone", "-q", "--bare", work, filepath.Join(repos, "test.git"))
+	runGit(t, work, "remote", "add", "served", filepath.Join(repos, "test.git"))
+
+	c := config.Default()
+	c.Repo.ScanPath = config.ScanPaths{{Path: repos}}
+	rt := Handlers(c, os.DirFS(".."))
+
+	srv := httptest.NewServer(rt)
+	t.Cleanup(srv.Close)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dm := rt.Daemon(ln)
+	go dm.Serve()
+	t.Cleanup(func() { dm.Shutdown(context.Background()) })
+
+	return work, map[string]string{
+		"http": srv.URL + "/test.git",
+		"git":  "git://" + ln.Addr().String() + "/test.git",
+	}
+}
+
+func TestClone(t *testing.T) {
+	_, urls := cloneFixture(t)
+
+	tests := []struct {
+		name string
+		args []string
+		// How many commits the clone should have, and whether it should
+		// be missing objects.
+		commits int
+		missing bool
+	}{
+		{"full", nil, 6, false},
+		{"depth", []string{"--depth", "1"}, 1, false},
+		{"since", []string{"--shallow-since", "2020-01-04T00:00:00Z"}, 3, false},
+		{"blob-none", []string{"--filter=blob:none"}, 6, true},
+		{"blob-limit", []string{"--filter=blob:limit=1k"}, 6, true},
+		{"tree-0", []string{"--filter=tree:0"}, 6, true},
+	}
+
+	for _, version := range []string{"0", "2"} {
+		for _, transport := range []string{"http", "git"} {
+			for _, tt := range tests {
+				t.Run(fmt.Sprintf("v%s/%s/%s", version, transport, tt.name), func(t *testing.T) {
+					dir := t.TempDir()
+					args := append([]string{"-c", "protocol.version=" + version, "clone", "-q"}, tt.args...)
+					runGit(t, dir, append(args, urls[transport], "clone")...)
+
+					clone := filepath.Join(dir, "clone")
+					runGit(t, clone, "fsck", "--no-progress")
+					if n := runGit(t, clone, "rev-list", "--count", "HEAD"); n != strconv.Itoa(tt.commits) {
+						t.Errorf("got %s commits, want %d", n, tt.commits)
+					}
+
+					missing := runGit(t, clone, "rev-list", "--objects", "--missing=print", "HEAD")
+					if got := strings.Contains(missing, "\n?"); got != tt.missing {
+						t.Errorf("missing objects: %v, want %v", got, tt.missing)
+					}
+				})
+			}
+		}
+	}
+}
+
+func TestFetch(t *testing.T) {
+	work, urls := cloneFixture(t)
+
+	// Clones made before the push, to fetch it into.
+	dirs := map[string]string{}
+	for _, version := range []string{"0", "2"} {
+		for _, transport := range []string{"http", "git"} {
+			for _, depth := range []string{"full", "shallow"} {
+				name := fmt.Sprintf("v%s/%s/%s", version, transport, depth)
+				dir := t.TempDir()
+				args := []string{"-c", "protocol.version=" + version, "clone", "-q"}
+				if depth == "shallow" {
+					args = append(args, "--depth", "2")
+				}
+				runGit(t, dir, append(args, urls[transport], "clone")...)
+				dirs[name] = filepath.Join(dir, "clone")
+			}
+		}
+	}
+
+	if err := os.WriteFile(filepath.Join(work, "new.txt"), []byte("new\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	commitDay(t, work, 7, "day 7")
+	runGit(t, work, "push", "-q", "served", "master")
+	head := runGit(t, work, "rev-parse", "HEAD")
+
+	for name, clone := range dirs {
+		t.Run(name, func(t *testing.T) {
+			version := strings.TrimPrefix(strings.Split(name, "/")[0], "v")
+			runGit(t, clone, "-c", "protocol.version="+version, "fetch", "-q", "origin")
+			runGit(t, clone, "fsck", "--no-progress")
+			if got := runGit(t, clone, "rev-parse", "origin/master"); got != head {
+				t.Errorf("origin/master is %s, want %s", got, head)
+			}
+
+			if strings.HasSuffix(name, "shallow") {
+				runGit(t, clone, "-c", "protocol.version="+version, "fetch", "-q", "--unshallow", "origin")
+				runGit(t, clone, "fsck", "--no-progress")
+				if n := runGit(t, clone, "rev-list", "--count", "origin/master"); n != "7" {
+					t.Errorf("got %s commits after unshallowing, want 7", n)
+				}
+			}
+		})
+	}
+}
+
+func TestUploadPackBadBody(t *testing.T) {
+	_, urls := cloneFixture(t)
+	url := urls["http"] + "/git-upload-pack"
+
+	// Haves, each "0032have <hash>\n", gzipped well under the limit and
+	// over it once inflated.
+	var big bytes.Buffer
+	zw := gzip.NewWriter(&big)
+	zw.Write([]byte("0032want " + strings.Repeat("0", 40) + "\n0000"))
+	for i := 0; i < (20<<20)/50; i++ {
+		zw.Write([]byte("0032have " + strings.Repeat("1", 40) + "\n"))
+	}
+	zw.Close()
+
+	tests := []struct {
+		name   string
+		body   []byte
+		gzip   bool
+		status int
+	}{
+		{"garbage", []byte("garbage"), false, http.StatusBadRequest},
+		{"bad gzip", []byte("garbage"), true, http.StatusBadRequest},
+		{"too big", big.Bytes(), true, http.StatusRequestEntityTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, _ := http.NewRequest("POST", url, bytes.NewReader(tt.body))
+			req.Header.Set("Content-Type", "application/x-git-upload-pack-request")
+			if tt.gzip {
+				req.Header.Set("Content-Encoding", "gzip")
+			}
+			res, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer res.Body.Close()
+			body, _ := io.ReadAll(res.Body)
+			if res.StatusCode != tt.status {
+				t.Errorf("got %d %q, want %d", res.StatusCode, body, tt.status)
+			}
+		})
+	}
+}
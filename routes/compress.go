@@ -0,0 +1,230 @@
+package routes
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+)
+
+// Responses smaller than this aren't worth compressing.
+const compressMinSize = 1024
+
+var compressibleTypes = map[string]bool{
+	"text/html":              true,
+	"text/css":               true,
+	"text/plain":             true,
+	"application/json":       true,
+	"application/javascript": true,
+	"text/javascript":        true,
+	"image/svg+xml":          true,
+}
+
+// Supported encodings, most preferred first.
+var encodings = []string{"br", "gzip"}
+
+// compress negotiates a Content-Encoding with the client and compresses
+// textual responses of at least compressMinSize bytes. Anything else,
+// like images or git pack streams, is passed through untouched.
+func compress(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Packfiles are already compressed, and buffering the start of
+		// the stream only delays the client. Range requests are for byte
+		// ranges of the uncompressed content.
+		if strings.HasSuffix(r.URL.Path, "/git-upload-pack") || r.Header.Get("Range") != "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Add("Vary", "Accept-Encoding")
+
+		enc := negotiateEncoding(r.Header.Get("Accept-Encoding"))
+		if enc == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// The ETags we hand out for compressed responses carry the
+		// encoding, strip it so handlers see their own tags. A 304 for
+		// one of those has to carry it too.
+		cw := &compressWriter{ResponseWriter: w, enc: enc}
+		if inm := r.Header.Get("If-None-Match"); inm != "" {
+			cw.encTag = strings.Contains(inm, "-"+enc+`"`)
+			r.Header.Set("If-None-Match", strings.ReplaceAll(inm, "-"+enc+`"`, `"`))
+		}
+
+		defer cw.Close()
+
+		next.ServeHTTP(cw, r)
+	})
+}
+
+// negotiateEncoding picks the best of our encodings the client accepts,
+// or "" for none.
+func negotiateEncoding(header string) string {
+	accepted := map[string]float64{}
+	for _, part := range strings.Split(header, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if f, err := strconv.ParseFloat(v, 64); err == nil {
+				q = f
+			}
+		}
+		accepted[strings.ToLower(strings.TrimSpace(name))] = q
+	}
+
+	best, bestQ := "", 0.0
+	for _, enc := range encodings {
+		q, ok := accepted[enc]
+		if !ok {
+			q, ok = accepted["*"]
+		}
+		if ok && q > bestQ {
+			best, bestQ = enc, q
+		}
+	}
+
+	return best
+}
+
+// compressWriter holds back the first compressMinSize bytes of a response
+// to decide whether it's worth compressing.
+type compressWriter struct {
+	http.ResponseWriter
+	enc    string
+	status int
+	buf    bytes.Buffer
+
+	// encTag is set if the client's copy came compressed, so its ETag
+	// has the encoding in it.
+	encTag bool
+
+	decided bool
+	zw      io.WriteCloser
+}
+
+func (cw *compressWriter) WriteHeader(status int) {
+	if cw.decided || cw.status != 0 {
+		return
+	}
+	cw.status = status
+
+	// Bodiless responses have nothing to wait for.
+	if status < 200 || status == http.StatusNoContent || status == http.StatusNotModified {
+		cw.decide(false)
+	}
+}
+
+func (cw *compressWriter) Write(b []byte) (int, error) {
+	if cw.decided {
+		if cw.zw != nil {
+			return cw.zw.Write(b)
+		}
+		return cw.ResponseWriter.Write(b)
+	}
+
+	cw.buf.Write(b)
+	if cw.buf.Len() >= compressMinSize {
+		if err := cw.decide(true); err != nil {
+			return 0, err
+		}
+	}
+
+	return len(b), nil
+}
+
+func (cw *compressWriter) Flush() {
+	if !cw.decided {
+		cw.decide(true)
+	}
+	if f, ok := cw.zw.(interface{ Flush() error }); ok {
+		f.Flush()
+	}
+	if f, ok := cw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (cw *compressWriter) Close() error {
+	if !cw.decided {
+		if err := cw.decide(cw.buf.Len() >= compressMinSize); err != nil {
+			return err
+		}
+	}
+	if cw.zw != nil {
+		return cw.zw.Close()
+	}
+	return nil
+}
+
+func (cw *compressWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
+
+// decide sends the headers, compressing the body if big says it's large
+// enough and the content type allows it, and writes out what's buffered.
+func (cw *compressWriter) decide(big bool) error {
+	cw.decided = true
+
+	h := cw.Header()
+	if cw.status == 0 {
+		cw.status = http.StatusOK
+	}
+	if h.Get("Content-Type") == "" && cw.buf.Len() > 0 {
+		h.Set("Content-Type", http.DetectContentType(cw.buf.Bytes()))
+	}
+
+	if big && h.Get("Content-Encoding") == "" && isCompressible(h.Get("Content-Type")) {
+		h.Set("Content-Encoding", cw.enc)
+		h.Del("Content-Length")
+		cw.tagEncoding()
+
+		switch cw.enc {
+		case "br":
+			cw.zw = brotli.NewWriterLevel(cw.ResponseWriter, 5)
+		case "gzip":
+			cw.zw = gzip.NewWriter(cw.ResponseWriter)
+		}
+	}
+
+	if cw.status == http.StatusNotModified && cw.encTag {
+		cw.tagEncoding()
+	}
+
+	cw.ResponseWriter.WriteHeader(cw.status)
+	if cw.buf.Len() == 0 {
+		return nil
+	}
+
+	var err error
+	if cw.zw != nil {
+		_, err = cw.zw.Write(cw.buf.Bytes())
+	} else {
+		_, err = cw.ResponseWriter.Write(cw.buf.Bytes())
+	}
+	cw.buf.Reset()
+
+	return err
+}
+
+func isCompressible(contentType string) bool {
+	mt, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return compressibleTypes[mt]
+}
+
+// tagEncoding marks the ETag as being for the compressed body.
+func (cw *compressWriter) tagEncoding() {
+	h := cw.Header()
+	if etag := h.Get("ETag"); strings.HasSuffix(etag, `"`) {
+		h.Set("ETag", strings.TrimSuffix(etag, `"`)+"-"+cw.enc+`"`)
+	}
+}
@@ -0,0 +1,499 @@
+package routes
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"git.icyphox.sh/legit/git"
+	"github.com/go-git/go-git/v5/plumbing/format/pktline"
+	"github.com/go-git/go-git/v5/plumbing/protocol/packp/capability"
+)
+
+// The git:// protocol, see git-daemon(1) and gitprotocol-pack(5). Only
+// upload-pack is served, for the same repos as over HTTP. Version 2
+// clients get the same ls-refs and fetch as over HTTP; older ones get
+// upload-pack's stateful negotiation, on top of the same git.Server.
+
+// Daemon serves git:// on a listener.
+type Daemon struct {
+	d     *deps
+	ln    net.Listener
+	conns chan struct{}
+	// Connections being told there are too many; see reject.
+	rejects chan struct{}
+
+	mu     sync.Mutex
+	active map[net.Conn]struct{}
+	closed bool
+	wg     sync.WaitGroup
+}
+
+// Daemon sets up a git:// server on ln, taking its settings from the
+// daemon section of the config.
+func (rt *Router) Daemon(ln net.Listener) *Daemon {
+	dm := &Daemon{
+		d:       rt.d,
+		ln:      ln,
+		rejects: make(chan struct{}, maxRejects),
+		active:  map[net.Conn]struct{}{},
+	}
+	if n := rt.d.c().Daemon.MaxConns; n > 0 {
+		dm.conns = make(chan struct{}, n)
+	}
+	return dm
+}
+
+// Serve accepts connections until Shutdown is called.
+func (dm *Daemon) Serve() error {
+	slog.Info("starting git daemon", "addr", dm.ln.Addr().String())
+	for {
+		conn, err := dm.ln.Accept()
+		if err != nil {
+			dm.mu.Lock()
+			closed := dm.closed
+			dm.mu.Unlock()
+			if closed {
+				return nil
+			}
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				continue
+			}
+			return err
+		}
+
+		// Connections over the limit are turned away before anything's
+		// read from them, so they can't hold up those being served. A
+		// few are told why; the rest are hung up on.
+		full := false
+		if dm.conns != nil {
+			select {
+			case dm.conns <- struct{}{}:
+			default:
+				full = true
+			}
+		}
+		if full {
+			select {
+			case dm.rejects <- struct{}{}:
+			default:
+				limited.WithLabelValues("daemon").Inc()
+				conn.Close()
+				continue
+			}
+		}
+
+		dm.mu.Lock()
+		dm.active[conn] = struct{}{}
+		dm.wg.Add(1)
+		dm.mu.Unlock()
+
+		go func() {
+			defer dm.wg.Done()
+			if full {
+				dm.reject(conn)
+				<-dm.rejects
+			} else {
+				dm.serveConn(conn)
+				if dm.conns != nil {
+					<-dm.conns
+				}
+			}
+
+			dm.mu.Lock()
+			delete(dm.active, conn)
+			dm.mu.Unlock()
+		}()
+	}
+}
+
+// Shutdown stops accepting connections and waits for the ones being
+// served to finish, or for ctx to be done, when they're cut off.
+func (dm *Daemon) Shutdown(ctx context.Context) error {
+	dm.mu.Lock()
+	dm.closed = true
+	dm.mu.Unlock()
+	dm.ln.Close()
+
+	done := make(chan struct{})
+	go func() {
+		dm.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		dm.mu.Lock()
+		for conn := range dm.active {
+			conn.Close()
+		}
+		dm.mu.Unlock()
+		<-done
+		return ctx.Err()
+	}
+}
+
+func (dm *Daemon) serveConn(nc net.Conn) {
+	defer nc.Close()
+	start := time.Now()
+	c := dm.d.c().Daemon
+
+	// The idle timeout takes over once the request is in.
+	conn := &idleConn{Conn: nc}
+	if c.InitTimeout > 0 {
+		nc.SetDeadline(time.Now().Add(c.InitTimeout))
+	}
+	r := bufio.NewReader(conn)
+
+	line, kind, err := readPkt(r)
+	if err == nil && kind != pktData {
+		err = errors.New("expected a request")
+	}
+	if err != nil {
+		slog.Warn("git daemon", "remote", nc.RemoteAddr().String(), "err", err)
+		return
+	}
+	service, name, version := parseDaemonRequest(line)
+	nc.SetDeadline(time.Time{})
+	conn.timeout = c.Timeout
+
+	// Clients turned away are told why once they've had their say;
+	// hanging up on them before that makes for a less helpful error.
+	host, _, _ := net.SplitHostPort(nc.RemoteAddr().String())
+	if ok, _ := dm.d.limits.Load().clone.allow(host); !ok {
+		limited.WithLabelValues("clone").Inc()
+		err = errPkt(conn, errors.New("too many requests, try again later"))
+	}
+	if err == nil {
+		err = dm.serve(conn, r, service, name, version)
+	}
+
+	slog.Info("git daemon",
+		"service", service,
+		"repo", name,
+		"version", version,
+		"remote", nc.RemoteAddr().String(),
+		"duration", time.Since(start),
+		"err", err,
+	)
+}
+
+// rejectTimeout is how long a client turned away for there being too
+// many connections has to send its request and hear why, and maxRejects
+// how many are given the chance at once.
+const (
+	rejectTimeout = 5 * time.Second
+	maxRejects    = 8
+)
+
+// reject tells a client there are too many connections, once it's sent
+// its request, if it does so quickly.
+func (dm *Daemon) reject(nc net.Conn) {
+	defer nc.Close()
+	limited.WithLabelValues("daemon").Inc()
+	nc.SetDeadline(time.Now().Add(rejectTimeout))
+
+	err := errors.New("too many connections, try again later")
+	if _, _, rerr := readPkt(bufio.NewReader(nc)); rerr == nil {
+		err = errPkt(nc, err)
+	}
+	slog.Warn("git daemon", "remote", nc.RemoteAddr().String(), "err", err)
+}
+
+// parseDaemonRequest splits a request like
+// "git-upload-pack /repo.git\0host=example.com\0\0version=2\0".
+func parseDaemonRequest(line string) (service, name string, version int) {
+	cmd, params, _ := strings.Cut(line, "\x00")
+	service, path, _ := strings.Cut(cmd, " ")
+	name = strings.Trim(path, "/")
+
+	for _, p := range strings.Split(params, "\x00") {
+		if p == "version=2" {
+			version = 2
+		}
+	}
+	return service, name, version
+}
+
+func (dm *Daemon) serve(conn net.Conn, r *bufio.Reader, service, name string, version int) error {
+	if service != "git-upload-pack" {
+		return errPkt(conn, fmt.Errorf("service %s not enabled", service))
+	}
+
+	rp, ok := dm.d.resolveRepo(name)
+	if !ok {
+		return errPkt(conn, fmt.Errorf("repository %s not found", name))
+	}
+	srv, err := git.OpenServer(rp.Path)
+	if err != nil {
+		return internalErrPkt(conn, err)
+	}
+
+	s := &uploadSession{
+		rp:  rp,
+		srv: srv,
+		slot: func() (func(), bool) {
+			packs := dm.d.limits.Load().packs
+			if !packs.acquire(context.Background()) {
+				limited.WithLabelValues("packs").Inc()
+				errPkt(conn, errors.New("too many clones in progress, try again later"))
+				return nil, false
+			}
+			return packs.release, true
+		},
+	}
+
+	if version == 2 {
+		return s.serveV2(conn, r)
+	}
+	return s.uploadPack(conn, r)
+}
+
+// serveV2 answers commands until the client hangs up.
+func (s *uploadSession) serveV2(w io.Writer, r *bufio.Reader) error {
+	if err := writeV2Capabilities(w); err != nil {
+		return err
+	}
+	for {
+		req, err := readV2Request(r)
+		if errors.Is(err, io.EOF) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if err := s.command(w, req); err != nil {
+			return err
+		}
+	}
+}
+
+// v0Capabilities is what uploadPack advertises.
+func v0Capabilities(refs []git.Ref) []string {
+	caps := []string{
+		"multi_ack_detailed",
+		"side-band-64k",
+		"ofs-delta",
+		"shallow",
+		"deepen-since",
+		"deepen-not",
+		"deepen-relative",
+		"no-progress",
+		"include-tag",
+		"filter",
+		// Any object can be asked for, as in version 2, which is how
+		// partial clones fetch what they left out.
+		"allow-reachable-sha1-in-want",
+	}
+	if len(refs) > 0 && refs[0].Name == "HEAD" && refs[0].Target != "" {
+		caps = append(caps, "symref=HEAD:"+refs[0].Target)
+	}
+	return append(caps, "agent="+capability.DefaultAgent())
+}
+
+// uploadPack speaks protocol version 0 (and 1, which is the same apart
+// from a version line) on a connection: refs are advertised, and then
+// the client negotiates what to fetch.
+func (s *uploadSession) uploadPack(w io.Writer, r *bufio.Reader) error {
+	refs, err := s.srv.Refs()
+	if err != nil {
+		return internalErrPkt(w, err)
+	}
+	if err := writeV0Refs(w, refs); err != nil {
+		return err
+	}
+	return s.negotiate(w, r, false)
+}
+
+// negotiate reads what the client wants, and what it has until it's
+// done, and sends the pack. With multi_ack_detailed, each have we have
+// is acknowledged as common and each flush gets a NAK; without it, only
+// the first have is. Over HTTP, which is stateless, a request is a single
+// round that ends at the first flush, and the client repeats its wants
+// and the haves we had in common in the next one.
+func (s *uploadSession) negotiate(w io.Writer, r *bufio.Reader, stateless bool) error {
+	// What the client wants, up to a flush. Capabilities come after the
+	// first want, and the ones that matter here are arguments in version
+	// 2, so they're turned into those.
+	var args []string
+	var sideBand, multiAck bool
+	for {
+		line, kind, err := readPkt(r)
+		if errors.Is(err, io.EOF) && len(args) == 0 {
+			// Just looking, like ls-remote.
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if kind != pktData {
+			break
+		}
+
+		if len(args) == 0 {
+			fields := strings.Fields(line)
+			line = strings.Join(fields[:min(2, len(fields))], " ")
+			for _, c := range fields[min(2, len(fields)):] {
+				switch c {
+				case "side-band-64k":
+					sideBand = true
+				case "multi_ack_detailed":
+					multiAck = true
+				case "include-tag", "deepen-relative":
+					args = append(args, c)
+				}
+			}
+		}
+		args = append(args, line)
+	}
+	if len(args) == 0 {
+		return nil
+	}
+
+	req, _, err := parseFetch(s.srv, args)
+	if err != nil {
+		return errPkt(w, err)
+	}
+	e := pktline.NewEncoder(w)
+
+	// Shallow commits only depend on the wants, and come before the
+	// negotiation, in every round of it over HTTP. Walking the history
+	// for them is work like making a pack, so it takes a turn too.
+	if req.Deepens() {
+		release, ok := s.slot()
+		if !ok {
+			return nil
+		}
+		shallow, unshallow, err := s.srv.ShallowUpdate(req)
+		release()
+		if err != nil {
+			return internalErrPkt(w, err)
+		}
+		if err := errors.Join(writeShallow(e, shallow, unshallow), e.Flush()); err != nil {
+			return err
+		}
+	}
+
+	for {
+		line, kind, err := readPkt(r)
+		if stateless && errors.Is(err, io.EOF) {
+			// Requests that only ask for the shallow commits end here.
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		if have, ok := strings.CutPrefix(line, "have "); ok {
+			h, err := parseHash(have)
+			if err != nil {
+				return errPkt(w, err)
+			}
+			if !s.srv.Has(h) {
+				continue
+			}
+			req.Haves = append(req.Haves, h)
+			if multiAck {
+				err = e.EncodeString("ACK " + h.String() + " common\n")
+			} else if len(req.Haves) == 1 {
+				err = e.EncodeString("ACK " + h.String() + "\n")
+			}
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		if kind == pktFlush {
+			if multiAck || len(req.Haves) == 0 {
+				if err := e.EncodeString("NAK\n"); err != nil {
+					return err
+				}
+			}
+			if stateless {
+				return nil
+			}
+			continue
+		}
+		if line == "done" {
+			break
+		}
+	}
+
+	switch {
+	case len(req.Haves) == 0:
+		err = e.EncodeString("NAK\n")
+	case multiAck:
+		err = e.EncodeString("ACK " + req.Haves[len(req.Haves)-1].String() + "\n")
+	}
+	if err != nil {
+		return err
+	}
+
+	release, ok := s.slot()
+	if !ok {
+		return nil
+	}
+	defer release()
+
+	pack, err := s.srv.PreparePack(req)
+	if err != nil {
+		return internalErrPkt(w, err)
+	}
+	return s.writePack(w, pack, sideBand)
+}
+
+// writeV0Refs advertises refs, with capabilities after the first one.
+func writeV0Refs(w io.Writer, refs []git.Ref) error {
+	caps := "\x00" + strings.Join(v0Capabilities(refs), " ")
+	e := pktline.NewEncoder(w)
+	for _, ref := range refs {
+		if ref.Hash.IsZero() {
+			continue
+		}
+		if err := e.EncodeString(ref.Hash.String() + " " + ref.Name + caps + "\n"); err != nil {
+			return err
+		}
+		caps = ""
+		if !ref.Peeled.IsZero() {
+			if err := e.EncodeString(ref.Peeled.String() + " " + ref.Name + "^{}\n"); err != nil {
+				return err
+			}
+		}
+	}
+	if caps != "" {
+		// No refs, but capabilities still need saying.
+		zero := strings.Repeat("0", 40)
+		if err := e.EncodeString(zero + " capabilities^{}" + caps + "\n"); err != nil {
+			return err
+		}
+	}
+	return e.Flush()
+}
+
+// idleConn cuts off clients that go quiet for longer than timeout.
+type idleConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (c *idleConn) Read(p []byte) (int, error) {
+	if c.timeout > 0 {
+		c.SetDeadline(time.Now().Add(c.timeout))
+	}
+	return c.Conn.Read(p)
+}
+
+func (c *idleConn) Write(p []byte) (int, error) {
+	if c.timeout > 0 {
+		c.SetDeadline(time.Now().Add(c.timeout))
+	}
+	return c.Conn.Write(p)
+}
@@ -0,0 +1,148 @@
+package routes
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"git.icyphox.sh/legit/git"
+	"github.com/alexedwards/flow"
+)
+
+// The dumb HTTP protocol, see gitprotocol-http(5): clients fetch refs
+// and objects as plain files. Only these paths in a repo are served, so
+// that config, hooks and the like stay private.
+var dumbPath = regexp.MustCompile(`^(HEAD|info/refs|objects/info/packs|objects/[0-9a-f]{2}/[0-9a-f]{38}|objects/pack/pack-[0-9a-f]{40}\.(pack|idx))$`)
+
+// isDumbRequest reports whether r is for the dumb protocol: for one of
+// the files it fetches, or for anything else under objects/, which gets
+// a 404 rather than the repo's page. info/refs with a service is for the
+// smart protocol.
+func isDumbRequest(r *http.Request, path string) bool {
+	if path == "info/refs" && r.URL.RawQuery != "" {
+		return false
+	}
+	return dumbPath.MatchString(path) || strings.HasPrefix(path, "objects/")
+}
+
+// Dumb serves a file for the dumb protocol. info/refs and
+// objects/info/packs are generated, since repos only have them if
+// git update-server-info is run after every push.
+func (d *deps) Dumb(w http.ResponseWriter, r *http.Request) {
+	rp, ok := d.resolveRepo(repoName(r))
+	if !ok {
+		http.Error(w, "repository not found", 404)
+		return
+	}
+
+	dir := git.Dir(rp.Path)
+	path := flow.Param(r.Context(), "...")
+	if !dumbPath.MatchString(path) {
+		// Like objects/info/alternates, which would give away paths.
+		http.Error(w, "not found", 404)
+		return
+	}
+
+	var body []byte
+	var err error
+	switch path {
+	case "info/refs":
+		body, err = infoRefs(rp.Path)
+	case "objects/info/packs":
+		body, err = infoPacks(dir)
+	default:
+		serveObject(w, r, filepath.Join(dir, filepath.FromSlash(path)), path)
+		return
+	}
+	if err != nil {
+		http.Error(w, http.StatusText(500), 500)
+		slog.ErrorContext(r.Context(), "git", "err", err)
+		return
+	}
+
+	w.Header().Set("content-type", "text/plain; charset=utf-8")
+	w.Header().Set("cache-control", "no-cache")
+	w.Write(body)
+}
+
+// infoRefs lists refs the way git update-server-info does, with peeled
+// tags following the tag.
+func infoRefs(path string) ([]byte, error) {
+	srv, err := git.OpenServer(path)
+	if err != nil {
+		return nil, err
+	}
+	refs, err := srv.Refs()
+	if err != nil {
+		return nil, err
+	}
+
+	var b bytes.Buffer
+	for _, ref := range refs {
+		if ref.Name == "HEAD" || ref.Hash.IsZero() {
+			continue
+		}
+		fmt.Fprintf(&b, "%s\t%s\n", ref.Hash, ref.Name)
+		if !ref.Peeled.IsZero() {
+			fmt.Fprintf(&b, "%s\t%s^{}\n", ref.Peeled, ref.Name)
+		}
+	}
+	return b.Bytes(), nil
+}
+
+// infoPacks lists the packs in dir.
+func infoPacks(dir string) ([]byte, error) {
+	packs, err := filepath.Glob(filepath.Join(dir, "objects", "pack", "pack-*.pack"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(packs)
+
+	var b bytes.Buffer
+	for _, p := range packs {
+		fmt.Fprintf(&b, "P %s\n", filepath.Base(p))
+	}
+	b.WriteString("\n")
+	return b.Bytes(), nil
+}
+
+// serveObject serves HEAD, or a loose object or pack file, which never
+// change once written.
+func serveObject(w http.ResponseWriter, r *http.Request, file, path string) {
+	// Only regular files, not symlinks to who knows where.
+	fi, err := os.Lstat(file)
+	if err != nil || !fi.Mode().IsRegular() {
+		http.Error(w, "not found", 404)
+		return
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		http.Error(w, "not found", 404)
+		return
+	}
+	defer f.Close()
+
+	switch {
+	case path == "HEAD":
+		w.Header().Set("content-type", "text/plain; charset=utf-8")
+		w.Header().Set("cache-control", "no-cache")
+	case strings.HasSuffix(path, ".pack"):
+		w.Header().Set("content-type", "application/x-git-packed-objects")
+	case strings.HasSuffix(path, ".idx"):
+		w.Header().Set("content-type", "application/x-git-packed-objects-toc")
+	default:
+		w.Header().Set("content-type", "application/x-git-loose-object")
+	}
+	if path != "HEAD" {
+		w.Header().Set("cache-control", "public, max-age=31536000, immutable")
+	}
+
+	http.ServeContent(w, r, "", time.Time{}, f)
+}
@@ -1,108 +1,108 @@
 package routes
 
 import (
-	"errors"
-	"log"
+	"bufio"
+	"log/slog"
 	"net/http"
-	"path/filepath"
 
-	"github.com/alexedwards/flow"
-	"github.com/go-git/go-billy/v5/osfs"
+	"git.icyphox.sh/legit/git"
 	"github.com/go-git/go-git/v5/plumbing/format/pktline"
-	"github.com/go-git/go-git/v5/plumbing/protocol/packp"
-	"github.com/go-git/go-git/v5/plumbing/transport"
-	"github.com/go-git/go-git/v5/plumbing/transport/server"
 )
 
 func (d *deps) InfoRefs(w http.ResponseWriter, r *http.Request) {
-	name := flow.Param(r.Context(), "name")
-	name = filepath.Clean(name)
-
-	repo := filepath.Join(d.c.Repo.ScanPath, name)
-
-	w.Header().Set("content-type", "application/x-git-upload-pack-advertisement")
-
-	ep, err := transport.NewEndpoint("/")
-	if err != nil {
-		http.Error(w, err.Error(), 500)
-		log.Printf("git: %s", err)
+	name := repoName(r)
+	rp, ok := d.resolveRepo(name)
+	if !ok {
+		http.Error(w, "repository not found", 404)
 		return
 	}
 
-	billyfs := osfs.New(repo)
-	loader := server.NewFilesystemLoader(billyfs)
-	srv := server.NewServer(loader)
-	session, err := srv.NewUploadPackSession(ep, nil)
-	if err != nil {
-		http.Error(w, err.Error(), 500)
-		log.Printf("git: %s", err)
+	if wantsV2(r) {
+		d.infoRefsV2(w, r)
 		return
 	}
 
-	ar, err := session.AdvertisedReferencesContext(r.Context())
-	if errors.Is(err, transport.ErrRepositoryNotFound) {
-		http.Error(w, err.Error(), 404)
+	srv, err := git.OpenServer(rp.Path)
+	if err != nil {
+		http.Error(w, http.StatusText(500), 500)
+		slog.ErrorContext(r.Context(), "git", "err", err)
 		return
-	} else if err != nil {
-		http.Error(w, err.Error(), 500)
+	}
+	refs, err := srv.Refs()
+	if err != nil {
+		http.Error(w, http.StatusText(500), 500)
+		slog.ErrorContext(r.Context(), "git", "err", err)
 		return
 	}
 
-	ar.Prefix = [][]byte{
-		[]byte("# service=git-upload-pack"),
-		pktline.Flush,
+	w.Header().Set("content-type", "application/x-git-upload-pack-advertisement")
+	e := pktline.NewEncoder(w)
+	err = e.EncodeString("# service=git-upload-pack\n")
+	if err == nil {
+		err = e.Flush()
 	}
-
-	if err = ar.Encode(w); err != nil {
-		http.Error(w, err.Error(), 500)
-		log.Printf("git: %s", err)
-		return
+	if err == nil {
+		err = writeV0Refs(w, refs)
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "git", "err", err)
 	}
 }
 
 func (d *deps) UploadPack(w http.ResponseWriter, r *http.Request) {
-	name := flow.Param(r.Context(), "name")
-	name = filepath.Clean(name)
-
-	repo := filepath.Join(d.c.Repo.ScanPath, name)
-
-	w.Header().Set("content-type", "application/x-git-upload-pack-result")
-
-	upr := packp.NewUploadPackRequest()
-	err := upr.Decode(r.Body)
-	if err != nil {
-		http.Error(w, err.Error(), 400)
-		log.Printf("git: %s", err)
+	name := repoName(r)
+	rp, ok := d.resolveRepo(name)
+	if !ok {
+		http.Error(w, "repository not found", 404)
 		return
 	}
 
-	ep, err := transport.NewEndpoint("/")
+	body, err := d.gitBody(w, r)
 	if err != nil {
-		http.Error(w, err.Error(), 500)
-		log.Printf("git: %s", err)
+		http.Error(w, err.Error(), bodyStatus(err))
+		slog.ErrorContext(r.Context(), "git", "err", err)
+		return
+	}
+	if isProbe(body) {
+		w.Header().Set("content-type", "application/x-git-upload-pack-result")
 		return
 	}
 
-	billyfs := osfs.New(repo)
-	loader := server.NewFilesystemLoader(billyfs)
-	svr := server.NewServer(loader)
-	session, err := svr.NewUploadPackSession(ep, nil)
-	if err != nil {
-		http.Error(w, err.Error(), 500)
-		log.Printf("git: %s", err)
+	if wantsV2(r) {
+		d.uploadPackV2(w, r, rp, body)
 		return
 	}
 
-	res, err := session.UploadPack(r.Context(), upr)
+	srv, err := git.OpenServer(rp.Path)
 	if err != nil {
-		http.Error(w, err.Error(), 500)
-		log.Printf("git: %s", err)
+		http.Error(w, http.StatusText(500), 500)
+		slog.ErrorContext(r.Context(), "git", "err", err)
 		return
 	}
 
-	if err = res.Encode(w); err != nil {
-		http.Error(w, err.Error(), 500)
-		log.Printf("git: %s", err)
-		return
+	// A round of negotiation per request; see negotiate.
+	s := &uploadSession{
+		rp:   rp,
+		srv:  srv,
+		slot: func() (func(), bool) { return d.packSlot(w, r) },
+	}
+	w.Header().Set("content-type", "application/x-git-upload-pack-result")
+	cw := &countWriter{w: w}
+	br := &bodyErrReader{r: body}
+	err = s.negotiate(cw, bufio.NewReader(br), true)
+	switch {
+	case err == nil:
+	case cw.n == 0:
+		// Nothing's been said yet, so there's still a status to say it
+		// with. Errors from before then are about the request.
+		w.Header().Del("content-type")
+		http.Error(w, err.Error(), bodyStatus(err))
+	case br.err != nil:
+		// Errors of our own have been sent already, but the client
+		// needs telling if it was cut off halfway.
+		errPkt(w, br.err)
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "git", "err", err)
 	}
 }
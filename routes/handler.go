@@ -1,9 +1,13 @@
 package routes
 
 import (
+	"io/fs"
 	"net/http"
+	"regexp"
+	"sync/atomic"
 
 	"git.icyphox.sh/legit/config"
+	"git.icyphox.sh/legit/webhook"
 	"github.com/alexedwards/flow"
 )
 
@@ -21,31 +25,100 @@ func (d *deps) Multiplex(w http.ResponseWriter, r *http.Request) {
 	if path == "info/refs" &&
 		r.URL.RawQuery == "service=git-upload-pack" &&
 		r.Method == "GET" {
-		d.InfoRefs(w, r)
+		instrument("info-refs", d.InfoRefs)(w, r)
 	} else if path == "git-upload-pack" && r.Method == "POST" {
-		d.UploadPack(w, r)
+		instrument("upload-pack", d.UploadPack)(w, r)
+	} else if isDumbRequest(r, path) && r.Method == "GET" {
+		instrument("dumb", d.Dumb)(w, r)
 	} else if r.Method == "GET" {
-		d.RepoIndex(w, r)
+		instrument("repo", d.RepoIndex)(w, r)
 	}
 }
 
-func Handlers(c *config.Config) *flow.Mux {
+// Router serves legit's routes, and lets the config be swapped out while
+// running.
+type Router struct {
+	d   *deps
+	mux atomic.Pointer[flow.Mux]
+}
+
+// Handlers sets up the routes. assets holds the default templates/ and
+// static/ trees, which dirs.templates and dirs.static can override.
+func Handlers(c *config.Config, assets fs.FS) *Router {
+	d := &deps{assets: assets, index: &repoIndex{}}
+	d.cfg.Store(c)
+
+	rt := &Router{d: d}
+	rt.mux.Store(d.routes())
+	return rt
+}
+
+// Webhooks has repos' webhooks pages show the deliveries in q. It's
+// meant to be called before serving.
+func (rt *Router) Webhooks(q *webhook.Queue) {
+	rt.d.hooks = q
+}
+
+func (rt *Router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rt.mux.Load().ServeHTTP(w, r)
+}
+
+// Reload switches to config c. Requests already being handled keep the
+// routes and middleware they started with, but read settings as they go,
+// so they may see some of the old config and some of c.
+func (rt *Router) Reload(c *config.Config) {
+	rt.d.cfg.Store(c)
+	rt.d.index.invalidate()
+	rt.mux.Store(rt.d.routes())
+}
+
+func (d *deps) routes() *flow.Mux {
 	mux := flow.New()
-	d := deps{c}
 
-	mux.NotFound = http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
-		d.Write404(w)
+	limits := newLimits(d.c())
+	d.limits.Store(limits)
+
+	mux.Use(accessLog)
+	mux.Use(d.securityHeaders)
+	mux.Use(d.rateLimit(limits))
+	mux.Use(compress)
+
+	mux.NotFound = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		d.Write404(w, r)
 	})
 
-	mux.HandleFunc("/", d.Index, "GET")
-	mux.HandleFunc("/static/:file", d.ServeStatic, "GET")
-	mux.HandleFunc("/:name", d.Multiplex, "GET", "POST")
-	mux.HandleFunc("/:name/tree/:ref/...", d.RepoTree, "GET")
-	mux.HandleFunc("/:name/blob/:ref/...", d.FileContent, "GET")
-	mux.HandleFunc("/:name/log/:ref", d.Log, "GET")
-	mux.HandleFunc("/:name/commit/:ref", d.Diff, "GET")
-	mux.HandleFunc("/:name/refs", d.Refs, "GET")
-	mux.HandleFunc("/:name/...", d.Multiplex, "GET", "POST")
+	base := d.c().Server.BasePath
+	if base != "" {
+		mux.HandleFunc(base, func(w http.ResponseWriter, r *http.Request) {
+			http.Redirect(w, r, base+"/", http.StatusMovedPermanently)
+		}, "GET")
+	}
+
+	mux.HandleFunc(base+"/", instrument("index", d.Index), "GET")
+	mux.HandleFunc(base+"/index.json", instrument("index.json", d.IndexJSON), "GET")
+	mux.HandleFunc(base+"/static/:file", instrument("static", d.ServeStatic), "GET")
+
+	// Repos in scan paths with a prefix live under it; these go first so
+	// that the prefix isn't taken for a repo name.
+	for _, sp := range d.c().Repo.ScanPath {
+		if sp.Prefix != "" {
+			d.repoRoutes(mux, base+"/:prefix|^"+regexp.QuoteMeta(sp.Prefix)+"$")
+		}
+	}
+	d.repoRoutes(mux, base)
 
 	return mux
 }
+
+// repoRoutes sets up the routes for repos under root.
+func (d *deps) repoRoutes(mux *flow.Mux, root string) {
+	// Multiplex instruments whatever it passes the request on to.
+	mux.HandleFunc(root+"/:name", d.Multiplex, "GET", "POST")
+	mux.HandleFunc(root+"/:name/tree/:ref/...", instrument("tree", d.RepoTree), "GET")
+	mux.HandleFunc(root+"/:name/blob/:ref/...", instrument("blob", d.FileContent), "GET")
+	mux.HandleFunc(root+"/:name/log/:ref", instrument("log", d.Log), "GET")
+	mux.HandleFunc(root+"/:name/commit/:ref", instrument("commit", d.Diff), "GET")
+	mux.HandleFunc(root+"/:name/refs", instrument("refs", d.Refs), "GET")
+	mux.HandleFunc(root+"/:name/webhooks", instrument("webhooks", d.Webhooks), "GET")
+	mux.HandleFunc(root+"/:name/...", d.Multiplex, "GET", "POST")
+}
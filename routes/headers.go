@@ -0,0 +1,80 @@
+package routes
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"git.icyphox.sh/legit/config"
+)
+
+// Where meta.fonts: cdn gets Inter from.
+const (
+	fontsOrigin = "https://cdn.icyphox.sh"
+	fontsCSS    = fontsOrigin + "/fonts/inter.css"
+)
+
+// securityHeaders sets the headers from server.headers on every
+// response.
+func (d *deps) securityHeaders(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h := d.c().Server.Headers
+
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		if csp := d.csp(); csp != "" {
+			w.Header().Set("Content-Security-Policy", csp)
+		}
+		if h.ReferrerPolicy != "" {
+			w.Header().Set("Referrer-Policy", h.ReferrerPolicy)
+		}
+		if h.FrameOptions != "" {
+			w.Header().Set("X-Frame-Options", h.FrameOptions)
+		}
+		if r.TLS != nil && h.HSTS > 0 {
+			w.Header().Set("Strict-Transport-Security", fmt.Sprintf("max-age=%d", int(h.HSTS.Seconds())))
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// csp returns the Content-Security-Policy to send. The default templates
+// have no inline scripts or styles, so the default policy only allows
+// stylesheets, fonts and images from legit itself, and the font CDN if
+// it's used.
+func (d *deps) csp() string {
+	c := d.c()
+	switch c.Server.Headers.CSP {
+	case "off":
+		return ""
+	case "":
+	default:
+		return c.Server.Headers.CSP
+	}
+
+	fonts := "'self'"
+	if c.Meta.Fonts == config.FontsCDN {
+		fonts += " " + fontsOrigin
+	}
+
+	return strings.Join([]string{
+		"default-src 'none'",
+		"style-src " + fonts,
+		"font-src " + fonts,
+		"img-src 'self'",
+		"form-action 'self'",
+		"base-uri 'none'",
+		"frame-ancestors 'none'",
+	}, "; ")
+}
+
+// fonts returns the stylesheet that loads Inter, if any.
+func (d *deps) fonts() string {
+	switch d.c().Meta.Fonts {
+	case config.FontsSelf:
+		return d.url("static", "inter.css")
+	case config.FontsNone:
+		return ""
+	}
+	return fontsCSS
+}
@@ -0,0 +1,352 @@
+package routes
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"git.icyphox.sh/legit/config"
+	"git.icyphox.sh/legit/git"
+	"github.com/dustin/go-humanize"
+	gogit "github.com/go-git/go-git/v5"
+)
+
+const (
+	// Number of repositories opened in parallel when building the index.
+	indexWorkers = 8
+	// How long a computed index is served before it's rebuilt in the
+	// background.
+	indexTTL = time.Minute
+)
+
+// repoInfo is what the index page shows for a single repository.
+type repoInfo struct {
+	Name     string
+	Desc     string
+	Owner    string
+	Section  string
+	Homepage string
+	// The scan path the repo was found in, see sourceKey.
+	Source     string
+	MainBranch string
+	LastCommit time.Time
+	// Set if the repository couldn't be read; the index shows it with
+	// an error badge instead of failing the whole page.
+	Err error
+}
+
+// repoGroup is the repos from a single scan path, as listed on the index.
+type repoGroup struct {
+	Name  string
+	Repos []repoInfo
+}
+
+// sourceName labels the repos from sp on the index: by its prefix if it
+// has one, otherwise by its directory name.
+func sourceName(sp config.ScanPath) string {
+	if sp.Prefix != "" {
+		return sp.Prefix
+	}
+	return filepath.Base(sp.Path)
+}
+
+// sourceKey tells scan paths apart on the index. Scan paths without a
+// prefix can share a directory name, and are still grouped apart.
+func sourceKey(sp config.ScanPath) string {
+	if sp.Prefix != "" {
+		return sp.Prefix
+	}
+	return sp.Path
+}
+
+// groupRepos splits infos up into sections: the one set with
+// legit.section, or else the scan path the repo was found in. Scan path
+// sections come first, in the order they're configured, followed by the
+// others by name. Empty sections are left out.
+func (d *deps) groupRepos(infos []repoInfo) []repoGroup {
+	groups := []repoGroup{}
+	// Scan path groups by sourceKey, and all groups by name, which is
+	// what sections go by.
+	bySource := map[string]int{}
+	byName := map[string]int{}
+	for _, sp := range d.c().Repo.ScanPath {
+		key, name := sourceKey(sp), sourceName(sp)
+		if _, ok := bySource[key]; ok {
+			continue
+		}
+		bySource[key] = len(groups)
+		if _, ok := byName[name]; !ok {
+			byName[name] = len(groups)
+		}
+		groups = append(groups, repoGroup{Name: name})
+	}
+
+	var sections []string
+	for _, info := range infos {
+		if _, ok := byName[info.Section]; info.Section != "" && !ok {
+			byName[info.Section] = -1
+			sections = append(sections, info.Section)
+		}
+	}
+	sort.Strings(sections)
+	for _, name := range sections {
+		byName[name] = len(groups)
+		groups = append(groups, repoGroup{Name: name})
+	}
+
+	for _, info := range infos {
+		i, ok := bySource[info.Source]
+		if info.Section != "" {
+			i, ok = byName[info.Section]
+		}
+		if ok {
+			groups[i].Repos = append(groups[i].Repos, info)
+		}
+	}
+
+	return slices.DeleteFunc(groups, func(g repoGroup) bool {
+		return len(g.Repos) == 0
+	})
+}
+
+// repoSorts are the orders the index can be sorted in, through the sort
+// query parameter. The first one is the default.
+var repoSorts = []struct {
+	Name string
+	cmp  func(a, b repoInfo) int
+}{
+	{"idle", func(a, b repoInfo) int {
+		return b.LastCommit.Compare(a.LastCommit)
+	}},
+	{"name", func(a, b repoInfo) int {
+		return strings.Compare(a.Name, b.Name)
+	}},
+	{"owner", func(a, b repoInfo) int {
+		// Repos without an owner go last.
+		if (a.Owner == "") != (b.Owner == "") {
+			if a.Owner == "" {
+				return 1
+			}
+			return -1
+		}
+		return cmp.Or(
+			strings.Compare(strings.ToLower(a.Owner), strings.ToLower(b.Owner)),
+			strings.Compare(a.Name, b.Name),
+		)
+	}},
+}
+
+// sortRepos sorts the repos in each of groups by the order called by,
+// falling back to the default one for unknown names. It returns the name
+// of the order used.
+func sortRepos(groups []repoGroup, by string) string {
+	s := repoSorts[0]
+	for _, rs := range repoSorts {
+		if rs.Name == by {
+			s = rs
+		}
+	}
+
+	for _, g := range groups {
+		slices.SortStableFunc(g.Repos, s.cmp)
+	}
+	return s.Name
+}
+
+// filterRepos returns the repos whose names contain q, ignoring case.
+func filterRepos(infos []repoInfo, q string) []repoInfo {
+	if q == "" {
+		return infos
+	}
+
+	q = strings.ToLower(q)
+	var matched []repoInfo
+	for _, info := range infos {
+		if strings.Contains(strings.ToLower(info.Name), q) {
+			matched = append(matched, info)
+		}
+	}
+	return matched
+}
+
+func (i repoInfo) Idle() string {
+	if i.LastCommit.IsZero() {
+		return ""
+	}
+	return humanize.Time(i.LastCommit)
+}
+
+// repoIndex caches the list of repositories shown on the index page.
+// A stale list is served as-is while a fresh one is built in the
+// background.
+type repoIndex struct {
+	mu         sync.Mutex
+	infos      []repoInfo
+	updated    time.Time
+	refreshing bool
+	// Bumped by invalidate, so that a refresh that was already running
+	// doesn't store a list built with the old config.
+	gen int
+}
+
+func (d *deps) repoInfos() ([]repoInfo, error) {
+	d.index.mu.Lock()
+	defer d.index.mu.Unlock()
+
+	cacheResult("index", !d.index.updated.IsZero())
+	if d.index.updated.IsZero() {
+		infos, err := d.scanRepos()
+		if err != nil {
+			return nil, err
+		}
+		d.index.infos, d.index.updated = infos, time.Now()
+	} else if time.Since(d.index.updated) > indexTTL && !d.index.refreshing {
+		d.index.refreshing = true
+		go d.refreshIndex(d.index.gen)
+	}
+
+	return d.index.infos, nil
+}
+
+// invalidate makes the next request rebuild the index, say because the
+// ignore list changed.
+func (ri *repoIndex) invalidate() {
+	ri.mu.Lock()
+	defer ri.mu.Unlock()
+
+	ri.infos, ri.updated = nil, time.Time{}
+	ri.refreshing = false
+	ri.gen++
+}
+
+func (d *deps) refreshIndex(gen int) {
+	infos, err := d.scanRepos()
+
+	d.index.mu.Lock()
+	defer d.index.mu.Unlock()
+
+	if gen != d.index.gen {
+		return
+	}
+	d.index.refreshing = false
+	if err != nil {
+		// Keep serving the old list.
+		slog.Error("refreshing index", "err", err)
+		return
+	}
+	d.index.infos, d.index.updated = infos, time.Now()
+}
+
+// scanRepos reads every repository in every scan path, at most
+// indexWorkers at a time.
+func (d *deps) scanRepos() ([]repoInfo, error) {
+	var jobs []repo
+	seen := map[string]bool{}
+	failed := 0
+	for _, sp := range d.c().Repo.ScanPath {
+		dirs, err := os.ReadDir(sp.Path)
+		if err != nil {
+			slog.Error("reading scan path", "path", sp.Path, "err", err)
+			failed++
+			continue
+		}
+
+		for _, dir := range dirs {
+			name := dir.Name()
+			if sp.Prefix != "" {
+				name = sp.Prefix + "/" + name
+			}
+			if sp.Prefix == "" && d.isPrefix(name) {
+				slog.Warn("repo is shadowed by a scan path prefix", "path", filepath.Join(sp.Path, name))
+				continue
+			}
+
+			// Earlier scan paths win.
+			if seen[name] {
+				slog.Warn("repo is shadowed by an earlier scan path", "path", filepath.Join(sp.Path, dir.Name()))
+				continue
+			}
+			seen[name] = true
+
+			if rp, ok := d.checkRepo(sp, name, dir.Name()); ok {
+				jobs = append(jobs, rp)
+			}
+		}
+	}
+
+	if failed > 0 && failed == len(d.c().Repo.ScanPath) {
+		return nil, fmt.Errorf("reading scan paths: all %d failed", failed)
+	}
+
+	infos := make([]*repoInfo, len(jobs))
+	sem := make(chan struct{}, indexWorkers)
+	var wg sync.WaitGroup
+
+	for i, rp := range jobs {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, rp repo) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			infos[i] = d.readRepoInfo(rp)
+		}(i, rp)
+	}
+	wg.Wait()
+
+	list := []repoInfo{}
+	for _, info := range infos {
+		if info != nil {
+			list = append(list, *info)
+		}
+	}
+
+	sort.SliceStable(list, func(i, j int) bool {
+		return list[j].LastCommit.Before(list[i].LastCommit)
+	})
+
+	return list, nil
+}
+
+// readRepoInfo returns nil if rp turns out not to be a git repository
+// after all.
+func (d *deps) readRepoInfo(rp repo) *repoInfo {
+	name, meta := rp.Name, rp.Meta
+	info := repoInfo{
+		Name:     name,
+		Desc:     meta.Description,
+		Owner:    meta.Owner,
+		Section:  meta.Section,
+		Homepage: meta.Homepage,
+		Source:   sourceKey(rp.ScanPath),
+	}
+
+	gr, err := git.Open(rp.Path, "")
+	if errors.Is(err, gogit.ErrRepositoryNotExists) {
+		return nil
+	} else if err != nil {
+		slog.Warn("reading repo", "repo", name, "err", err)
+		info.Err = err
+		return &info
+	}
+
+	c, err := gr.LastCommit()
+	if err != nil {
+		slog.Warn("reading last commit", "repo", name, "err", err)
+		info.Err = err
+		return &info
+	}
+	info.LastCommit = c.Author.When
+
+	// Non-fatal, the index doesn't need it.
+	info.MainBranch, _ = gr.FindMainBranch(d.mainBranches(meta))
+
+	return &info
+}
@@ -0,0 +1,46 @@
+package routes
+
+import (
+	"fmt"
+	"testing"
+
+	"git.icyphox.sh/legit/config"
+)
+
+func TestGroupRepos(t *testing.T) {
+	c := config.Default()
+	c.Repo.ScanPath = config.ScanPaths{
+		{Path: "/a/repos"},
+		{Path: "/b/repos"},
+		{Path: "/c/mirrors", Prefix: "mirrors"},
+	}
+	d := &deps{}
+	d.cfg.Store(c)
+
+	var infos []repoInfo
+	for _, sp := range c.Repo.ScanPath {
+		infos = append(infos, repoInfo{Name: sp.Path + "/x.git", Source: sourceKey(sp)})
+	}
+	infos = append(infos,
+		repoInfo{Name: "tools.git", Source: "/a/repos", Section: "tools"},
+		repoInfo{Name: "moved.git", Source: "/a/repos", Section: "mirrors"},
+	)
+
+	var got []string
+	for _, g := range d.groupRepos(infos) {
+		var names []string
+		for _, info := range g.Repos {
+			names = append(names, info.Name)
+		}
+		got = append(got, fmt.Sprintf("%s%v", g.Name, names))
+	}
+	want := []string{
+		"repos[/a/repos/x.git]",
+		"repos[/b/repos/x.git]",
+		"mirrors[/c/mirrors/x.git moved.git]",
+		"tools[tools.git]",
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
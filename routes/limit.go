@@ -0,0 +1,280 @@
+package routes
+
+import (
+	"context"
+	"math"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"git.icyphox.sh/legit/config"
+	"golang.org/x/time/rate"
+)
+
+// Clients that haven't made a request in this long are forgotten, along
+// with their token buckets.
+const clientTTL = 10 * time.Minute
+
+// limits holds the state behind the limits config. It's rebuilt, and
+// the state lost, when the config is reloaded.
+type limits struct {
+	browse, clone *clientLimits
+	packs         *packGate
+
+	// proxies and unix are limits.trustedProxies.
+	proxies []netip.Prefix
+	unix    bool
+}
+
+func newLimits(c *config.Config) *limits {
+	l := c.Limits
+	// Already validated.
+	proxies, unix, _ := config.ParseProxies(l.TrustedProxies)
+	return &limits{
+		browse:  newClientLimits(l.Browse),
+		clone:   newClientLimits(l.Clone),
+		packs:   newPackGate(l.Packs, l.PackQueue, l.PackWait),
+		proxies: proxies,
+		unix:    unix,
+	}
+}
+
+// clientLimits is a token bucket per client.
+type clientLimits struct {
+	limit rate.Limit
+	burst int
+
+	mu      sync.Mutex
+	clients map[string]*clientLimit
+	swept   time.Time
+}
+
+type clientLimit struct {
+	*rate.Limiter
+	seen time.Time
+}
+
+// newClientLimits returns nil if r doesn't limit anything.
+func newClientLimits(r config.Rate) *clientLimits {
+	if r.Rate == 0 {
+		return nil
+	}
+	return &clientLimits{
+		limit:   rate.Limit(r.Rate),
+		burst:   r.Burst,
+		clients: map[string]*clientLimit{},
+		swept:   time.Now(),
+	}
+}
+
+// allow takes a token from client's bucket. If there's none left, it
+// returns false and how long until there will be.
+func (cl *clientLimits) allow(client string) (bool, time.Duration) {
+	if cl == nil {
+		return true, 0
+	}
+
+	now := time.Now()
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+
+	if now.Sub(cl.swept) > clientTTL {
+		for k, c := range cl.clients {
+			if now.Sub(c.seen) > clientTTL {
+				delete(cl.clients, k)
+			}
+		}
+		cl.swept = now
+	}
+
+	c, ok := cl.clients[client]
+	if !ok {
+		c = &clientLimit{Limiter: rate.NewLimiter(cl.limit, cl.burst)}
+		cl.clients[client] = c
+	}
+	c.seen = now
+
+	res := c.ReserveN(now, 1)
+	if delay := res.DelayFrom(now); delay > 0 {
+		res.CancelAt(now)
+		return false, delay
+	}
+	return true, 0
+}
+
+// packGate caps the number of packs generated at once. Clones beyond
+// that wait in a queue of bounded length, for a bounded time.
+type packGate struct {
+	slots  chan struct{}
+	queued atomic.Int64
+	queue  int64
+	wait   time.Duration
+}
+
+// newPackGate returns nil if n is zero, leaving packs unlimited.
+func newPackGate(n, queue int, wait time.Duration) *packGate {
+	if n == 0 {
+		return nil
+	}
+	return &packGate{slots: make(chan struct{}, n), queue: int64(queue), wait: wait}
+}
+
+// acquire waits for a slot and reports whether it got one. Each
+// successful acquire must be followed by a release.
+func (g *packGate) acquire(ctx context.Context) bool {
+	if g == nil {
+		return true
+	}
+
+	select {
+	case g.slots <- struct{}{}:
+		return true
+	default:
+	}
+
+	if g.queued.Add(1) > g.queue {
+		g.queued.Add(-1)
+		return false
+	}
+	defer g.queued.Add(-1)
+
+	ctx, cancel := context.WithTimeout(ctx, g.wait)
+	defer cancel()
+	select {
+	case g.slots <- struct{}{}:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func (g *packGate) release() {
+	if g != nil {
+		<-g.slots
+	}
+}
+
+// Clones turned away because too many packs are being generated are
+// told to come back after this long.
+const packRetryAfter = 10 * time.Second
+
+// packSlot waits for a turn to generate a pack. If there's none to be
+// had, it tells the client to come back later and returns false.
+func (d *deps) packSlot(w http.ResponseWriter, r *http.Request) (release func(), ok bool) {
+	packs := d.limits.Load().packs
+	if !packs.acquire(r.Context()) {
+		limited.WithLabelValues("packs").Inc()
+		retryAfter(w, packRetryAfter)
+		http.Error(w, "too many clones in progress, try again later", http.StatusServiceUnavailable)
+		return nil, false
+	}
+	return packs.release, true
+}
+
+// clientID tells clients apart for rate limiting: by limits.clientHeader
+// if it's set and the request came through a trusted proxy, which is
+// the only one that gets to say, or else by address.
+func (d *deps) clientID(r *http.Request) string {
+	l := d.limits.Load()
+	if h := d.c().Limits.ClientHeader; h != "" && l.trusted(remoteHost(r)) {
+		if id := r.Header.Get(h); id != "" {
+			return h + ":" + id
+		}
+	}
+	return l.clientAddr(r)
+}
+
+// remoteHost is the host part of r.RemoteAddr, or all of it if it's not
+// an address, as over server.socket.
+func remoteHost(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// clientAddr returns the address r came from. For requests from a
+// trusted proxy, that's the last address in X-Forwarded-For that isn't a
+// trusted proxy too, or else X-Real-IP.
+func (l *limits) clientAddr(r *http.Request) string {
+	host := remoteHost(r)
+	if !l.trusted(host) {
+		return host
+	}
+
+	fwd := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(fwd) - 1; i >= 0; i-- {
+		addr, err := netip.ParseAddr(strings.TrimSpace(fwd[i]))
+		if err != nil {
+			break
+		}
+		if !l.trusted(addr.String()) {
+			return addr.Unmap().String()
+		}
+	}
+	if addr, err := netip.ParseAddr(strings.TrimSpace(r.Header.Get("X-Real-IP"))); err == nil {
+		return addr.Unmap().String()
+	}
+	return host
+}
+
+// trusted reports whether host is a trusted proxy. Anything that isn't
+// an address came in over server.socket.
+func (l *limits) trusted(host string) bool {
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return l.unix
+	}
+	addr = addr.Unmap()
+	for _, p := range l.proxies {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// isGitRequest reports whether r is for one of the git HTTP protocols,
+// which count towards the clone limits rather than the browse ones.
+func isGitRequest(r *http.Request) bool {
+	return strings.HasSuffix(r.URL.Path, "/info/refs") ||
+		strings.HasSuffix(r.URL.Path, "/git-upload-pack") ||
+		strings.Contains(r.URL.Path, "/objects/")
+}
+
+// rateLimit turns clients away with a 429 once they've used up their
+// budget. Static assets don't count.
+func (d *deps) rateLimit(l *limits) func(http.Handler) http.Handler {
+	static := d.c().Server.BasePath + "/static/"
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if strings.HasPrefix(r.URL.Path, static) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			kind, cl := "browse", l.browse
+			if isGitRequest(r) {
+				kind, cl = "clone", l.clone
+			}
+
+			if ok, wait := cl.allow(d.clientID(r)); !ok {
+				limited.WithLabelValues(kind).Inc()
+				retryAfter(w, wait)
+				http.Error(w, "too many requests", http.StatusTooManyRequests)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func retryAfter(w http.ResponseWriter, d time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(d.Seconds()))))
+}
@@ -0,0 +1,80 @@
+package routes
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"git.icyphox.sh/legit/config"
+)
+
+func TestClientAddr(t *testing.T) {
+	c := config.Default()
+	c.Limits.TrustedProxies = []string{"127.0.0.1", "10.0.0.0/8", "unix"}
+	l := newLimits(c)
+
+	tests := []struct {
+		remote, fwd, realIP string
+		want                string
+	}{
+		{"192.0.2.1:1234", "", "", "192.0.2.1"},
+		// Only proxies get to say who they're forwarding for.
+		{"192.0.2.1:1234", "198.51.100.7", "198.51.100.8", "192.0.2.1"},
+		{"127.0.0.1:1234", "198.51.100.7", "", "198.51.100.7"},
+		{"127.0.0.1:1234", "203.0.113.9, 198.51.100.7, 10.1.2.3", "", "198.51.100.7"},
+		{"[::ffff:127.0.0.1]:1234", "198.51.100.7", "", "198.51.100.7"},
+		{"127.0.0.1:1234", "", "198.51.100.8", "198.51.100.8"},
+		{"127.0.0.1:1234", "garbage", "", "127.0.0.1"},
+		{"@", "198.51.100.7", "", "198.51.100.7"},
+		{"", "", "", ""},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = tt.remote
+		if tt.fwd != "" {
+			r.Header.Set("X-Forwarded-For", tt.fwd)
+		}
+		if tt.realIP != "" {
+			r.Header.Set("X-Real-IP", tt.realIP)
+		}
+		if got := l.clientAddr(r); got != tt.want {
+			t.Errorf("clientAddr(%q, X-Forwarded-For %q, X-Real-IP %q) = %q, want %q",
+				tt.remote, tt.fwd, tt.realIP, got, tt.want)
+		}
+	}
+}
+
+func TestClientID(t *testing.T) {
+	c := config.Default()
+	c.Limits.ClientHeader = "X-Forwarded-User"
+	c.Limits.TrustedProxies = []string{"127.0.0.1", "unix"}
+	d := &deps{}
+	d.cfg.Store(c)
+	d.limits.Store(newLimits(c))
+
+	tests := []struct {
+		remote, user, fwd string
+		want              string
+	}{
+		{"127.0.0.1:1234", "alice", "", "X-Forwarded-User:alice"},
+		{"@", "alice", "", "X-Forwarded-User:alice"},
+		{"127.0.0.1:1234", "", "198.51.100.7", "198.51.100.7"},
+		// Anyone else could make up a new one each time to get a fresh
+		// bucket.
+		{"192.0.2.1:1234", "alice", "", "192.0.2.1"},
+		{"192.0.2.1:1234", "mallory", "198.51.100.7", "192.0.2.1"},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = tt.remote
+		if tt.user != "" {
+			r.Header.Set("X-Forwarded-User", tt.user)
+		}
+		if tt.fwd != "" {
+			r.Header.Set("X-Forwarded-For", tt.fwd)
+		}
+		if got := d.clientID(r); got != tt.want {
+			t.Errorf("clientID(%q, X-Forwarded-User %q, X-Forwarded-For %q) = %q, want %q",
+				tt.remote, tt.user, tt.fwd, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package routes
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	httpRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "legit_http_requests_total",
+		Help: "HTTP requests handled, by route, method and status code.",
+	}, []string{"route", "method", "code"})
+
+	httpDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "legit_http_request_duration_seconds",
+		Help:    "Time taken to handle HTTP requests, by route.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"route"})
+
+	uploadPacks = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "legit_upload_pack_total",
+		Help: "git-upload-pack requests served, by repository.",
+	}, []string{"repo"})
+
+	uploadPackBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "legit_upload_pack_bytes_total",
+		Help: "Bytes sent in git-upload-pack responses, by repository.",
+	}, []string{"repo"})
+
+	templateErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "legit_template_errors_total",
+		Help: "Errors rendering templates, by template name.",
+	}, []string{"template"})
+
+	limited = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "legit_limited_total",
+		Help: "Requests turned away by limits, by limit (browse, clone or packs).",
+	}, []string{"limit"})
+
+	cacheRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "legit_cache_requests_total",
+		Help: "Cache lookups, by cache (index or etag) and result (hit or miss).",
+	}, []string{"cache", "result"})
+)
+
+// MetricsHandler serves the metrics in the Prometheus exposition format.
+func MetricsHandler() http.Handler {
+	return promhttp.Handler()
+}
+
+func cacheResult(cache string, hit bool) {
+	result := "miss"
+	if hit {
+		result = "hit"
+	}
+	cacheRequests.WithLabelValues(cache, result).Inc()
+}
+
+// instrument wraps h to count requests and time them under route.
+func instrument(route string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: w}
+
+		h(sw, r)
+
+		if sw.status == 0 {
+			sw.status = http.StatusOK
+		}
+		httpRequests.WithLabelValues(route, r.Method, strconv.Itoa(sw.status)).Inc()
+		httpDuration.WithLabelValues(route).Observe(time.Since(start).Seconds())
+	}
+}
+
+// statusWriter records the status code and the number of bytes written.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (sw *statusWriter) WriteHeader(status int) {
+	if sw.status == 0 {
+		sw.status = status
+	}
+	sw.ResponseWriter.WriteHeader(status)
+}
+
+func (sw *statusWriter) Write(b []byte) (int, error) {
+	if sw.status == 0 {
+		sw.status = http.StatusOK
+	}
+	n, err := sw.ResponseWriter.Write(b)
+	sw.bytes += int64(n)
+	return n, err
+}
+
+func (sw *statusWriter) Flush() {
+	if f, ok := sw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (sw *statusWriter) Unwrap() http.ResponseWriter {
+	return sw.ResponseWriter
+}
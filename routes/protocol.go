@@ -0,0 +1,452 @@
+package routes
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"git.icyphox.sh/legit/git"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/format/pktline"
+	"github.com/go-git/go-git/v5/plumbing/protocol/packp/capability"
+)
+
+// Git protocol version 2, see gitprotocol-v2(5). go-git's server only
+// speaks versions 0 and 1, so ls-refs and fetch are implemented here on
+// top of git.Server, along with shallow and partial clones. Clients that
+// don't ask for version 2 get the go-git server, and full clones.
+
+// wantsV2 reports whether the client asked for protocol version 2.
+func wantsV2(r *http.Request) bool {
+	for _, h := range r.Header.Values("Git-Protocol") {
+		for _, p := range strings.Split(h, ":") {
+			if p == "version=2" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// v2Capabilities is what infoRefsV2 advertises.
+func v2Capabilities() []string {
+	return []string{
+		"version 2",
+		"agent=" + capability.DefaultAgent(),
+		"ls-refs=unborn",
+		"fetch=shallow filter",
+		"object-format=sha1",
+	}
+}
+
+// infoRefsV2 advertises capabilities instead of refs, without the
+// "# service" line version 1 starts with.
+func (d *deps) infoRefsV2(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("content-type", "application/x-git-upload-pack-advertisement")
+	if err := writeV2Capabilities(w); err != nil {
+		slog.ErrorContext(r.Context(), "git", "err", err)
+	}
+}
+
+func writeV2Capabilities(w io.Writer) error {
+	e := pktline.NewEncoder(w)
+	for _, c := range v2Capabilities() {
+		if err := e.EncodeString(c + "\n"); err != nil {
+			return err
+		}
+	}
+	return e.Flush()
+}
+
+// Special packets, which have a length below 4 in place of a payload.
+const (
+	pktData = iota
+	pktFlush
+	pktDelim
+	pktEnd
+)
+
+// readPkt reads one pkt-line. go-git's scanner doesn't know about delim
+// and response-end packets, which version 2 uses.
+func readPkt(r *bufio.Reader) (line string, kind int, err error) {
+	var hdr [4]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return "", 0, err
+	}
+
+	n, err := strconv.ParseUint(string(hdr[:]), 16, 16)
+	if err != nil {
+		return "", 0, fmt.Errorf("bad pkt-line length %q", hdr)
+	}
+	switch n {
+	case 0:
+		return "", pktFlush, nil
+	case 1:
+		return "", pktDelim, nil
+	case 2:
+		return "", pktEnd, nil
+	case 3:
+		return "", 0, errors.New("bad pkt-line length 3")
+	}
+
+	buf := make([]byte, n-4)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return "", 0, err
+	}
+	return strings.TrimSuffix(string(buf), "\n"), pktData, nil
+}
+
+// v2Request is a single command. Over HTTP there's one per request.
+type v2Request struct {
+	command string
+	caps    []string
+	args    []string
+}
+
+// readV2Request reads a command, or returns io.EOF if the client is done
+// sending them.
+func readV2Request(r *bufio.Reader) (*v2Request, error) {
+	line, kind, err := readPkt(r)
+	if err != nil {
+		return nil, err
+	}
+	if kind == pktFlush {
+		return nil, io.EOF
+	}
+	command, ok := strings.CutPrefix(line, "command=")
+	if kind != pktData || !ok {
+		return nil, errors.New("expected a command")
+	}
+
+	req := &v2Request{command: command}
+	dst := &req.caps
+	for {
+		line, kind, err := readPkt(r)
+		if err != nil {
+			return nil, err
+		}
+
+		switch kind {
+		case pktData:
+			*dst = append(*dst, line)
+		case pktDelim:
+			dst = &req.args
+		default:
+			return req, nil
+		}
+	}
+}
+
+func (d *deps) uploadPackV2(w http.ResponseWriter, r *http.Request, rp repo, body *bufio.Reader) {
+	req, err := readV2Request(body)
+	if err != nil {
+		http.Error(w, err.Error(), bodyStatus(err))
+		slog.ErrorContext(r.Context(), "git", "err", err)
+		return
+	}
+
+	srv, err := git.OpenServer(rp.Path)
+	if err != nil {
+		http.Error(w, http.StatusText(500), 500)
+		slog.ErrorContext(r.Context(), "git", "err", err)
+		return
+	}
+
+	s := &uploadSession{
+		rp:   rp,
+		srv:  srv,
+		slot: func() (func(), bool) { return d.packSlot(w, r) },
+	}
+	w.Header().Set("content-type", "application/x-git-upload-pack-result")
+	if err := s.command(w, req); err != nil {
+		slog.ErrorContext(r.Context(), "git", "command", req.command, "err", err)
+	}
+}
+
+// uploadSession serves fetches from a repo, over HTTP or git://.
+type uploadSession struct {
+	rp  repo
+	srv *git.Server
+	// slot waits for a turn to generate a pack, see packSlot. If there's
+	// none to be had, it has told the client so and returns false.
+	slot func() (release func(), ok bool)
+}
+
+// command answers a version 2 command.
+func (s *uploadSession) command(w io.Writer, req *v2Request) error {
+	switch req.command {
+	case "ls-refs":
+		return s.lsRefs(w, req.args)
+	case "fetch":
+		return s.fetch(w, req.args)
+	}
+	return errPkt(w, fmt.Errorf("unknown command %q", req.command))
+}
+
+// errPkt tells the client about err, and returns it.
+func errPkt(w io.Writer, err error) error {
+	return errors.Join(err, pktline.NewEncoder(w).EncodeString("ERR "+err.Error()+"\n"))
+}
+
+// internalErrPkt tells the client something went wrong on our side, but
+// not what, as that can give away paths; err is returned for logging.
+// Objects it asked for that aren't there are its own doing, and it's
+// told about those.
+func internalErrPkt(w io.Writer, err error) error {
+	if errors.Is(err, plumbing.ErrObjectNotFound) {
+		return errPkt(w, err)
+	}
+	return errors.Join(err, pktline.NewEncoder(w).EncodeString("ERR internal error\n"))
+}
+
+func (s *uploadSession) lsRefs(w io.Writer, args []string) error {
+	var symrefs, peel, unborn bool
+	var prefixes []string
+	for _, a := range args {
+		switch {
+		case a == "symrefs":
+			symrefs = true
+		case a == "peel":
+			peel = true
+		case a == "unborn":
+			unborn = true
+		case strings.HasPrefix(a, "ref-prefix "):
+			prefixes = append(prefixes, strings.TrimPrefix(a, "ref-prefix "))
+		}
+	}
+
+	refs, err := s.srv.Refs()
+	if err != nil {
+		return internalErrPkt(w, err)
+	}
+
+	e := pktline.NewEncoder(w)
+	for _, ref := range refs {
+		if len(prefixes) > 0 && !hasAnyPrefix(ref.Name, prefixes) {
+			continue
+		}
+
+		var line string
+		if ref.Hash.IsZero() {
+			if !unborn {
+				continue
+			}
+			line = "unborn " + ref.Name
+		} else {
+			line = ref.Hash.String() + " " + ref.Name
+		}
+		if symrefs && ref.Target != "" {
+			line += " symref-target:" + ref.Target
+		}
+		if peel && !ref.Peeled.IsZero() {
+			line += " peeled:" + ref.Peeled.String()
+		}
+
+		if err := e.EncodeString(line + "\n"); err != nil {
+			return err
+		}
+	}
+	return e.Flush()
+}
+
+func hasAnyPrefix(s string, prefixes []string) bool {
+	for _, p := range prefixes {
+		if strings.HasPrefix(s, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// fetch negotiates statelessly: haves we have are acknowledged, and as
+// soon as there's at least one, or the client is done, the pack is sent.
+func (s *uploadSession) fetch(w io.Writer, args []string) error {
+	e := pktline.NewEncoder(w)
+
+	req, done, err := parseFetch(s.srv, args)
+	if err != nil {
+		return errPkt(w, err)
+	}
+
+	if !done && len(req.Haves) == 0 {
+		// Nothing in common yet; let the client send more haves.
+		return errors.Join(e.EncodeString("acknowledgments\n", "NAK\n"), e.Flush())
+	}
+
+	release, ok := s.slot()
+	if !ok {
+		return nil
+	}
+	defer release()
+
+	pack, err := s.srv.PreparePack(req)
+	if err != nil {
+		return internalErrPkt(w, err)
+	}
+
+	if !done {
+		acks := []string{"acknowledgments\n"}
+		for _, h := range req.Haves {
+			acks = append(acks, "ACK "+h.String()+"\n")
+		}
+		acks = append(acks, "ready\n")
+		if err := e.EncodeString(acks...); err != nil {
+			return err
+		}
+		if _, err := w.Write([]byte("0001")); err != nil {
+			return err
+		}
+	}
+	if req.Deepens() || len(req.Shallow) > 0 {
+		if err := e.EncodeString("shallow-info\n"); err != nil {
+			return err
+		}
+		if err := writeShallow(e, pack.Shallow, pack.Unshallow); err != nil {
+			return err
+		}
+		if _, err := w.Write([]byte("0001")); err != nil {
+			return err
+		}
+	}
+	if err := e.EncodeString("packfile\n"); err != nil {
+		return err
+	}
+	return s.writePack(w, pack, true)
+}
+
+func writeShallow(e *pktline.Encoder, shallow, unshallow []plumbing.Hash) error {
+	var lines []string
+	for _, h := range shallow {
+		lines = append(lines, "shallow "+h.String()+"\n")
+	}
+	for _, h := range unshallow {
+		lines = append(lines, "unshallow "+h.String()+"\n")
+	}
+	return e.EncodeString(lines...)
+}
+
+// writePack sends pack, on band 1 of a side-band-64k stream ended with a
+// flush if sideBand is set, or else as is.
+func (s *uploadSession) writePack(w io.Writer, pack *git.Pack, sideBand bool) error {
+	uploadPacks.WithLabelValues(s.rp.Name).Inc()
+	cw := &countWriter{w: w}
+	var out *bufio.Writer
+	if sideBand {
+		out = bufio.NewWriterSize(sideband{e: pktline.NewEncoder(cw), band: 1}, pktline.MaxPayloadSize-1)
+	} else {
+		out = bufio.NewWriter(cw)
+	}
+
+	err := pack.Encode(out)
+	if err == nil {
+		err = out.Flush()
+	}
+	uploadPackBytes.WithLabelValues(s.rp.Name).Add(float64(cw.n))
+
+	e := pktline.NewEncoder(w)
+	if err != nil && sideBand {
+		// Too late for anything else; tell the client on the error band,
+		// without the details, as internalErrPkt does. They're logged.
+		sideband{e: e, band: 3}.Write([]byte("internal error\n"))
+	}
+	if err != nil || !sideBand {
+		return err
+	}
+	return e.Flush()
+}
+
+// parseFetch reads the arguments to a fetch command. Haves and shallow
+// commits we don't have are left out.
+func parseFetch(srv *git.Server, args []string) (req git.PackRequest, done bool, err error) {
+	for _, a := range args {
+		arg, value, _ := strings.Cut(a, " ")
+		switch arg {
+		case "want", "have", "shallow":
+			h, err := parseHash(value)
+			if err != nil {
+				return req, false, err
+			}
+			switch {
+			case arg == "want":
+				req.Wants = append(req.Wants, h)
+			case !srv.Has(h):
+			case arg == "have":
+				req.Haves = append(req.Haves, h)
+			default:
+				req.Shallow = append(req.Shallow, h)
+			}
+		case "deepen":
+			req.Deepen, err = strconv.Atoi(value)
+			if err != nil || req.Deepen <= 0 {
+				return req, false, fmt.Errorf("bad deepen %q", value)
+			}
+		case "deepen-relative":
+			req.DeepenRelative = true
+		case "deepen-since":
+			t, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return req, false, fmt.Errorf("bad deepen-since %q", value)
+			}
+			req.DeepenSince = time.Unix(t, 0)
+		case "deepen-not":
+			req.DeepenNot = append(req.DeepenNot, value)
+		case "filter":
+			req.Filter, err = git.ParseFilter(value)
+			if err != nil {
+				return req, false, err
+			}
+		case "done":
+			done = true
+		case "include-tag":
+			req.IncludeTag = true
+		}
+	}
+	if len(req.Wants) == 0 {
+		return req, false, errors.New("fetch without wants")
+	}
+	return req, done, nil
+}
+
+func parseHash(s string) (plumbing.Hash, error) {
+	if _, err := hex.DecodeString(s); err != nil || len(s) != 40 {
+		return plumbing.ZeroHash, fmt.Errorf("bad object id %q", s)
+	}
+	return plumbing.NewHash(s), nil
+}
+
+// sideband writes to one band of a side-band-64k stream. go-git's muxer
+// can write packets that are too long, so this is done by hand.
+type sideband struct {
+	e    *pktline.Encoder
+	band byte
+}
+
+func (s sideband) Write(p []byte) (int, error) {
+	for n := 0; n < len(p); {
+		chunk := p[n:min(len(p), n+pktline.MaxPayloadSize-1)]
+		if err := s.e.Encode(append([]byte{s.band}, chunk...)); err != nil {
+			return n, err
+		}
+		n += len(chunk)
+	}
+	return len(p), nil
+}
+
+// countWriter counts the bytes written through it.
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,125 @@
+package routes
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+
+	"git.icyphox.sh/legit/config"
+	"git.icyphox.sh/legit/git"
+)
+
+// repo is a repository that a name from a URL resolved to.
+type repo struct {
+	// Name is as in URLs, including the scan path prefix.
+	Name     string
+	Path     string
+	ScanPath config.ScanPath
+	Meta     git.Meta
+}
+
+// resolveRepo turns the repo name from a URL into a repo on disk. This
+// is the only way handlers get from a request to a path, so everything
+// that keeps a repo from being served is checked here. Repos at the top
+// level are looked up in each scan path without a prefix in turn, and
+// the first one with a directory by that name wins. ok is false if
+// there's no such repo or it's ignored or hidden.
+func (d *deps) resolveRepo(name string) (rp repo, ok bool) {
+	if !validRepoName(name) {
+		return repo{}, false
+	}
+
+	for _, sp := range d.c().Repo.ScanPath {
+		dir := name
+		if sp.Prefix != "" {
+			var found bool
+			if dir, found = strings.CutPrefix(name, sp.Prefix+"/"); !found {
+				continue
+			}
+		} else if d.isPrefix(name) {
+			continue
+		}
+		if strings.Contains(dir, "/") {
+			continue
+		}
+
+		if _, err := os.Lstat(filepath.Join(sp.Path, dir)); err != nil {
+			continue
+		}
+		return d.checkRepo(sp, name, dir)
+	}
+
+	return repo{}, false
+}
+
+// checkRepo vets directory dir of sp, to be known as name. Both the
+// index and resolveRepo go through it, so that nothing is listed that
+// can't be served, and the other way around.
+func (d *deps) checkRepo(sp config.ScanPath, name, dir string) (rp repo, ok bool) {
+	if d.isIgnored(sp, name, dir) {
+		return repo{}, false
+	}
+
+	path := filepath.Join(sp.Path, dir)
+	if !d.insideScanPath(sp, path) || !isGitRepo(path) {
+		return repo{}, false
+	}
+
+	meta := git.ReadMeta(path)
+	if d.isHidden(sp, path, meta) {
+		return repo{}, false
+	}
+
+	return repo{Name: name, Path: path, ScanPath: sp, Meta: meta}, true
+}
+
+// validRepoName reports whether name is a clean, relative name of at
+// most two segments, none of them empty, "." or "..". Names that merely
+// clean up to a valid one, like foo/../foo, are rejected too.
+func validRepoName(name string) bool {
+	if name == "" || strings.ContainsAny(name, "\\\x00") {
+		return false
+	}
+
+	segs := strings.Split(name, "/")
+	if len(segs) > 2 {
+		return false
+	}
+	for _, s := range segs {
+		if s == "" || s == "." || s == ".." {
+			return false
+		}
+	}
+	return true
+}
+
+// insideScanPath reports whether path, with symlinks resolved, is still
+// inside sp. Symlinks leading elsewhere are only followed with
+// repo.followSymlinks set.
+func (d *deps) insideScanPath(sp config.ScanPath, path string) bool {
+	real, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return false
+	}
+	if d.c().Repo.FollowSymlinks {
+		return true
+	}
+
+	root, err := filepath.EvalSymlinks(sp.Path)
+	if err != nil {
+		return false
+	}
+	rel, err := filepath.Rel(root, real)
+	return err == nil && rel != "." && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// isGitRepo reports whether path looks like a bare or non-bare git
+// repository, without opening it.
+func isGitRepo(path string) bool {
+	dir := git.Dir(path)
+	fi, err := os.Stat(filepath.Join(dir, "objects"))
+	if err != nil || !fi.IsDir() {
+		return false
+	}
+	return exists(filepath.Join(dir, "HEAD"))
+}
@@ -0,0 +1,191 @@
+package routes
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"git.icyphox.sh/legit/config"
+)
+
+// resolveFixture lays out scan paths with repos that should and
+// shouldn't resolve, and returns deps serving them.
+//
+//	repos/pub.git          bare, public
+//	repos/work             non-bare, public
+//	repos/alias.git        symlink to pub.git
+//	repos/ign.git          in repo.ignore
+//	repos/hid.git          has a legit-hidden file
+//	repos/hidalias.git     symlink to hid.git
+//	repos/out.git          symlink to outside/ext.git
+//	repos/sub/nested.git   too deep
+//	repos/notgit           not a repo
+//	mirrors/m.git          hidden scan path, prefix mirrors
+//	mirrors/shown.git      hidden scan path, but legit.hidden = false
+//	outside/ext.git        not in any scan path
+func resolveFixture(t testing.TB, follow bool) (*deps, string) {
+	t.Helper()
+	root := t.TempDir()
+	if r, err := filepath.EvalSymlinks(root); err == nil {
+		root = r
+	}
+
+	bare := func(path string) {
+		t.Helper()
+		if err := os.MkdirAll(filepath.Join(path, "objects"), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(path, "HEAD"), []byte("ref: refs/heads/master\n"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write := func(path, data string) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	link := func(target, path string) {
+		t.Helper()
+		if err := os.Symlink(target, path); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	repos := filepath.Join(root, "repos")
+	mirrors := filepath.Join(root, "mirrors")
+	bare(filepath.Join(repos, "pub.git"))
+	bare(filepath.Join(repos, "work", ".git"))
+	link("pub.git", filepath.Join(repos, "alias.git"))
+	bare(filepath.Join(repos, "ign.git"))
+	bare(filepath.Join(repos, "hid.git"))
+	write(filepath.Join(repos, "hid.git", hiddenFile), "")
+	link("hid.git", filepath.Join(repos, "hidalias.git"))
+	bare(filepath.Join(root, "outside", "ext.git"))
+	link(filepath.Join(root, "outside", "ext.git"), filepath.Join(repos, "out.git"))
+	bare(filepath.Join(repos, "sub", "nested.git"))
+	if err := os.MkdirAll(filepath.Join(repos, "notgit"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	bare(filepath.Join(mirrors, "m.git"))
+	bare(filepath.Join(mirrors, "shown.git"))
+	write(filepath.Join(mirrors, "shown.git", "config"), "[legit]\n\thidden = false\n")
+
+	c := config.Default()
+	c.Repo.ScanPath = config.ScanPaths{
+		{Path: repos},
+		{Path: mirrors, Prefix: "mirrors", Visibility: config.Hidden},
+	}
+	c.Repo.Ignore = []string{"ign.git"}
+	c.Repo.FollowSymlinks = follow
+
+	d := &deps{}
+	d.cfg.Store(c)
+	return d, root
+}
+
+func TestResolveRepo(t *testing.T) {
+	d, root := resolveFixture(t, false)
+
+	tests := []struct {
+		name string
+		path string // empty if it shouldn't resolve
+	}{
+		{"pub.git", "repos/pub.git"},
+		{"work", "repos/work"},
+		{"alias.git", "repos/alias.git"},
+		{"mirrors/shown.git", "mirrors/shown.git"},
+		{"ign.git", ""},
+		{"hid.git", ""},
+		{"hidalias.git", ""},
+		{"out.git", ""},
+		{"sub/nested.git", ""},
+		{"notgit", ""},
+		{"mirrors/m.git", ""},
+		{"shown.git", ""},
+		{"mirrors", ""},
+		{"ext.git", ""},
+		{"../outside/ext.git", ""},
+		{"./pub.git", ""},
+		{"pub.git/..", ""},
+		{"sub/../pub.git", ""},
+		{"/pub.git", ""},
+		{"pub.git/", ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		rp, ok := d.resolveRepo(tt.name)
+		if tt.path == "" {
+			if ok {
+				t.Errorf("resolveRepo(%q) = %s, want nothing", tt.name, rp.Path)
+			}
+			continue
+		}
+		if want := filepath.Join(root, tt.path); !ok || rp.Path != want {
+			t.Errorf("resolveRepo(%q) = %q, %v, want %q", tt.name, rp.Path, ok, want)
+		}
+	}
+
+	// With followSymlinks, repos outside the scan path are fair game,
+	// but the ignore and hidden rules still apply.
+	d, _ = resolveFixture(t, true)
+	if _, ok := d.resolveRepo("out.git"); !ok {
+		t.Error("out.git doesn't resolve with followSymlinks")
+	}
+	for _, name := range []string{"ign.git", "hid.git", "hidalias.git", "mirrors/m.git"} {
+		if _, ok := d.resolveRepo(name); ok {
+			t.Errorf("%s resolves with followSymlinks", name)
+		}
+	}
+}
+
+func FuzzResolveRepo(f *testing.F) {
+	for _, s := range []string{
+		"pub.git", "work", "alias.git", "mirrors/shown.git", "ign.git",
+		"hid.git", "hidalias.git", "out.git", "sub/nested.git",
+		"mirrors/m.git", "../outside/ext.git", "mirrors/../out.git",
+		"pub.git/../../outside/ext.git", "./pub.git", "..", "/",
+		"pub.git\x00", "..\\outside\\ext.git", "mirrors//m.git",
+	} {
+		f.Add(s)
+	}
+
+	d, root := resolveFixture(f, false)
+	never := map[string]bool{
+		"repos/ign.git":        true,
+		"repos/hid.git":        true,
+		"outside/ext.git":      true,
+		"repos/sub":            true,
+		"repos/notgit":         true,
+		"mirrors/m.git":        true,
+		"repos/sub/nested.git": true,
+	}
+
+	f.Fuzz(func(t *testing.T, name string) {
+		rp, ok := d.resolveRepo(name)
+		if !ok {
+			return
+		}
+		if rp.Name != name {
+			t.Fatalf("resolveRepo(%q) named it %q", name, rp.Name)
+		}
+
+		real, err := filepath.EvalSymlinks(rp.Path)
+		if err != nil {
+			t.Fatalf("resolveRepo(%q) = %s, which doesn't exist: %v", name, rp.Path, err)
+		}
+		sp, err := filepath.EvalSymlinks(rp.ScanPath.Path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(real, sp+string(filepath.Separator)) {
+			t.Fatalf("resolveRepo(%q) = %s, outside of %s", name, real, sp)
+		}
+
+		rel, _ := filepath.Rel(root, real)
+		if never[filepath.ToSlash(rel)] {
+			t.Fatalf("resolveRepo(%q) = %s, which is ignored or hidden", name, real)
+		}
+	})
+}
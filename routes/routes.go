@@ -1,108 +1,137 @@
 package routes
 
 import (
+	"encoding/json"
 	"html/template"
-	"log"
+	"io/fs"
+	"log/slog"
 	"net/http"
-	"os"
-	"path/filepath"
+	"net/url"
 	"sort"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	"git.icyphox.sh/legit/config"
 	"git.icyphox.sh/legit/git"
+	"git.icyphox.sh/legit/webhook"
 	"github.com/alexedwards/flow"
-	"github.com/dustin/go-humanize"
 )
 
 type deps struct {
-	c *config.Config
+	cfg    atomic.Pointer[config.Config]
+	assets fs.FS
+	index  *repoIndex
+	limits atomic.Pointer[limits]
+	hooks  *webhook.Queue
+}
+
+// c returns the current config, which Router.Reload can swap out at any
+// time.
+func (d *deps) c() *config.Config {
+	return d.cfg.Load()
 }
 
 func (d *deps) Index(w http.ResponseWriter, r *http.Request) {
-	dirs, err := os.ReadDir(d.c.Repo.ScanPath)
+	infos, err := d.repoInfos()
 	if err != nil {
-		d.Write500(w)
-		log.Printf("reading scan path: %s", err)
+		d.Write500(w, r)
+		slog.ErrorContext(r.Context(), "reading index", "err", err)
 		return
 	}
 
-	type info struct {
-		Name, Desc, Idle string
-		d                time.Time
-	}
-
-	infos := []info{}
-
-	for _, dir := range dirs {
-		if d.isIgnored(dir.Name()) {
-			continue
-		}
-
-		path := filepath.Join(d.c.Repo.ScanPath, dir.Name())
-		gr, err := git.Open(path, "")
-		if err != nil {
-			continue
-		}
+	t := template.Must(d.templates())
 
-		c, err := gr.LastCommit()
-		if err != nil {
-			d.Write500(w)
-			log.Println(err)
-			return
-		}
+	q := strings.TrimSpace(r.URL.Query().Get("q"))
+	groups := d.groupRepos(filterRepos(infos, q))
 
-		desc := getDescription(path)
+	data := make(map[string]interface{})
+	data["meta"] = d.c().Meta
+	data["info"] = infos
+	data["groups"] = groups
+	data["sort"] = sortRepos(groups, r.URL.Query().Get("sort"))
+	data["sorts"] = repoSorts
+	data["query"] = q
 
-		infos = append(infos, info{
-			Name: dir.Name(),
-			Desc: desc,
-			Idle: humanize.Time(c.Author.When),
-			d:    c.Author.When,
-		})
+	if err := d.execute(t, w, "index", data); err != nil {
+		slog.ErrorContext(r.Context(), "rendering template", "template", "index", "err", err)
+		return
 	}
+}
 
-	sort.Slice(infos, func(i, j int) bool {
-		return infos[j].d.Before(infos[i].d)
-	})
-
-	tpath := filepath.Join(d.c.Dirs.Templates, "*")
-	t := template.Must(template.ParseGlob(tpath))
+// IndexJSON lists the repos on the index, with what they say about
+// themselves, for scripts. ?q= filters them as on the index.
+func (d *deps) IndexJSON(w http.ResponseWriter, r *http.Request) {
+	infos, err := d.repoInfos()
+	if err != nil {
+		d.Write500(w, r)
+		slog.ErrorContext(r.Context(), "reading index", "err", err)
+		return
+	}
 
-	data := make(map[string]interface{})
-	data["meta"] = d.c.Meta
-	data["info"] = infos
+	type repoJSON struct {
+		Name          string     `json:"name"`
+		Description   string     `json:"description,omitempty"`
+		Owner         string     `json:"owner,omitempty"`
+		Section       string     `json:"section,omitempty"`
+		Homepage      string     `json:"homepage,omitempty"`
+		DefaultBranch string     `json:"default_branch,omitempty"`
+		LastCommit    *time.Time `json:"last_commit,omitempty"`
+		// Set if the repo couldn't be read; the details are only logged.
+		Error bool `json:"error,omitempty"`
+	}
+	repos := []repoJSON{}
+	for _, info := range filterRepos(infos, strings.TrimSpace(r.URL.Query().Get("q"))) {
+		rj := repoJSON{
+			Name:          info.Name,
+			Description:   info.Desc,
+			Owner:         info.Owner,
+			Section:       info.Section,
+			Homepage:      info.Homepage,
+			DefaultBranch: info.MainBranch,
+			Error:         info.Err != nil,
+		}
+		if !info.LastCommit.IsZero() {
+			rj.LastCommit = &info.LastCommit
+		}
+		repos = append(repos, rj)
+	}
+	sort.Slice(repos, func(i, j int) bool { return repos[i].Name < repos[j].Name })
 
-	if err := t.ExecuteTemplate(w, "index", data); err != nil {
-		log.Println(err)
-		return
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(repos); err != nil {
+		slog.ErrorContext(r.Context(), "writing index", "err", err)
 	}
 }
 
 func (d *deps) RepoIndex(w http.ResponseWriter, r *http.Request) {
-	name := flow.Param(r.Context(), "name")
-	if d.isIgnored(name) {
-		d.Write404(w)
+	name := repoName(r)
+	rp, ok := d.resolveRepo(name)
+	if !ok {
+		d.Write404(w, r)
 		return
 	}
-	name = filepath.Clean(name)
-	path := filepath.Join(d.c.Repo.ScanPath, name)
 
-	gr, err := git.Open(path, "")
+	gr, err := git.Open(rp.Path, "")
 	if err != nil {
-		d.Write404(w)
+		d.Write404(w, r)
+		return
+	}
+
+	meta := rp.Meta
+	if d.notModified(w, r, "", gr.Hash(), meta) {
 		return
 	}
 
 	commits, err := gr.Commits()
 	if err != nil {
-		d.Write500(w)
-		log.Println(err)
+		d.Write500(w, r)
+		slog.ErrorContext(r.Context(), "reading commits", "err", err)
 		return
 	}
 
 	var readmeContent string
-	for _, readme := range d.c.Repo.Readme {
+	for _, readme := range d.readmes(rp.ScanPath) {
 		readmeContent, _ = gr.FileContent(readme)
 		if readmeContent != "" {
 			break
@@ -110,18 +139,17 @@ func (d *deps) RepoIndex(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if readmeContent == "" {
-		log.Printf("no readme found for %s", name)
+		slog.DebugContext(r.Context(), "no readme found")
 	}
 
-	mainBranch, err := gr.FindMainBranch(d.c.Repo.MainBranch)
+	mainBranch, err := gr.FindMainBranch(d.mainBranches(meta))
 	if err != nil {
-		d.Write500(w)
-		log.Println(err)
+		d.Write500(w, r)
+		slog.ErrorContext(r.Context(), "finding main branch", "err", err)
 		return
 	}
 
-	tpath := filepath.Join(d.c.Dirs.Templates, "*")
-	t := template.Must(template.ParseGlob(tpath))
+	t := template.Must(d.templates())
 
 	if len(commits) >= 3 {
 		commits = commits[:3]
@@ -132,11 +160,12 @@ func (d *deps) RepoIndex(w http.ResponseWriter, r *http.Request) {
 	data["ref"] = mainBranch
 	data["readme"] = readmeContent
 	data["commits"] = commits
-	data["desc"] = getDescription(path)
-	data["servername"] = d.c.Server.Name
+	data["desc"] = meta.Description
+	data["repo"] = meta
+	data["servername"] = d.c().Server.Name
 
-	if err := t.ExecuteTemplate(w, "repo", data); err != nil {
-		log.Println(err)
+	if err := d.execute(t, w, "repo", data); err != nil {
+		slog.ErrorContext(r.Context(), "rendering template", "template", "repo", "err", err)
 		return
 	}
 
@@ -144,26 +173,30 @@ func (d *deps) RepoIndex(w http.ResponseWriter, r *http.Request) {
 }
 
 func (d *deps) RepoTree(w http.ResponseWriter, r *http.Request) {
-	name := flow.Param(r.Context(), "name")
-	if d.isIgnored(name) {
-		d.Write404(w)
+	name := repoName(r)
+	rp, ok := d.resolveRepo(name)
+	if !ok {
+		d.Write404(w, r)
 		return
 	}
 	treePath := flow.Param(r.Context(), "...")
 	ref := flow.Param(r.Context(), "ref")
 
-	name = filepath.Clean(name)
-	path := filepath.Join(d.c.Repo.ScanPath, name)
-	gr, err := git.Open(path, ref)
+	gr, err := git.Open(rp.Path, ref)
 	if err != nil {
-		d.Write404(w)
+		d.Write404(w, r)
+		return
+	}
+
+	meta := rp.Meta
+	if d.notModified(w, r, ref, gr.Hash(), meta) {
 		return
 	}
 
 	files, err := gr.FileTree(treePath)
 	if err != nil {
-		d.Write500(w)
-		log.Println(err)
+		d.Write500(w, r)
+		slog.ErrorContext(r.Context(), "reading tree", "err", err)
 		return
 	}
 
@@ -171,166 +204,235 @@ func (d *deps) RepoTree(w http.ResponseWriter, r *http.Request) {
 	data["name"] = name
 	data["ref"] = ref
 	data["parent"] = treePath
-	data["desc"] = getDescription(path)
+	data["desc"] = meta.Description
+	data["repo"] = meta
 
-	d.listFiles(files, data, w)
+	d.listFiles(files, data, w, r)
 	return
 }
 
 func (d *deps) FileContent(w http.ResponseWriter, r *http.Request) {
-	name := flow.Param(r.Context(), "name")
-	if d.isIgnored(name) {
-		d.Write404(w)
+	name := repoName(r)
+	rp, ok := d.resolveRepo(name)
+	if !ok {
+		d.Write404(w, r)
 		return
 	}
 	treePath := flow.Param(r.Context(), "...")
 	ref := flow.Param(r.Context(), "ref")
 
-	name = filepath.Clean(name)
-	path := filepath.Join(d.c.Repo.ScanPath, name)
-	gr, err := git.Open(path, ref)
+	gr, err := git.Open(rp.Path, ref)
 	if err != nil {
-		d.Write404(w)
+		d.Write404(w, r)
 		return
 	}
 
+	// Before notModified, so that a missing file isn't cached.
 	contents, err := gr.FileContent(treePath)
+	if err != nil {
+		d.Write404(w, r)
+		return
+	}
+
+	meta := rp.Meta
+	if d.notModified(w, r, ref, gr.Hash(), meta) {
+		return
+	}
+
 	data := make(map[string]any)
 	data["name"] = name
 	data["ref"] = ref
-	data["desc"] = getDescription(path)
+	data["desc"] = meta.Description
+	data["repo"] = meta
 	data["path"] = treePath
 
-	d.showFile(contents, data, w)
+	d.showFile(contents, data, w, r)
 	return
 }
 
 func (d *deps) Log(w http.ResponseWriter, r *http.Request) {
-	name := flow.Param(r.Context(), "name")
-	if d.isIgnored(name) {
-		d.Write404(w)
+	name := repoName(r)
+	rp, ok := d.resolveRepo(name)
+	if !ok {
+		d.Write404(w, r)
 		return
 	}
 	ref := flow.Param(r.Context(), "ref")
 
-	path := filepath.Join(d.c.Repo.ScanPath, name)
-	gr, err := git.Open(path, ref)
+	gr, err := git.Open(rp.Path, ref)
 	if err != nil {
-		d.Write404(w)
+		d.Write404(w, r)
+		return
+	}
+
+	meta := rp.Meta
+	if d.notModified(w, r, ref, gr.Hash(), meta) {
 		return
 	}
 
 	commits, err := gr.Commits()
 	if err != nil {
-		d.Write500(w)
-		log.Println(err)
+		d.Write500(w, r)
+		slog.ErrorContext(r.Context(), "reading commits", "err", err)
 		return
 	}
 
-	tpath := filepath.Join(d.c.Dirs.Templates, "*")
-	t := template.Must(template.ParseGlob(tpath))
+	t := template.Must(d.templates())
 
 	data := make(map[string]interface{})
 	data["commits"] = commits
-	data["meta"] = d.c.Meta
+	data["meta"] = d.c().Meta
 	data["name"] = name
 	data["ref"] = ref
-	data["desc"] = getDescription(path)
+	data["desc"] = meta.Description
+	data["repo"] = meta
 
-	if err := t.ExecuteTemplate(w, "log", data); err != nil {
-		log.Println(err)
+	if err := d.execute(t, w, "log", data); err != nil {
+		slog.ErrorContext(r.Context(), "rendering template", "template", "log", "err", err)
 		return
 	}
 }
 
 func (d *deps) Diff(w http.ResponseWriter, r *http.Request) {
-	name := flow.Param(r.Context(), "name")
-	if d.isIgnored(name) {
-		d.Write404(w)
+	name := repoName(r)
+	rp, ok := d.resolveRepo(name)
+	if !ok {
+		d.Write404(w, r)
 		return
 	}
 	ref := flow.Param(r.Context(), "ref")
 
-	path := filepath.Join(d.c.Repo.ScanPath, name)
-	gr, err := git.Open(path, ref)
+	gr, err := git.Open(rp.Path, ref)
 	if err != nil {
-		d.Write404(w)
+		d.Write404(w, r)
+		return
+	}
+
+	meta := rp.Meta
+	if d.notModified(w, r, ref, gr.Hash(), meta) {
 		return
 	}
 
-	diff, err := gr.Diff()
+	diff, err := gr.Diff(r.Context())
 	if err != nil {
-		d.Write500(w)
-		log.Println(err)
+		d.Write500(w, r)
+		slog.ErrorContext(r.Context(), "reading diff", "err", err)
 		return
 	}
 
-	tpath := filepath.Join(d.c.Dirs.Templates, "*")
-	t := template.Must(template.ParseGlob(tpath))
+	t := template.Must(d.templates())
 
 	data := make(map[string]interface{})
 
 	data["commit"] = diff.Commit
 	data["stat"] = diff.Stat
 	data["diff"] = diff.Diff
-	data["meta"] = d.c.Meta
+	data["meta"] = d.c().Meta
 	data["name"] = name
 	data["ref"] = ref
-	data["desc"] = getDescription(path)
+	data["desc"] = meta.Description
+	data["repo"] = meta
 
-	if err := t.ExecuteTemplate(w, "commit", data); err != nil {
-		log.Println(err)
+	if err := d.execute(t, w, "commit", data); err != nil {
+		slog.ErrorContext(r.Context(), "rendering template", "template", "commit", "err", err)
 		return
 	}
 }
 
 func (d *deps) Refs(w http.ResponseWriter, r *http.Request) {
-	name := flow.Param(r.Context(), "name")
-	if d.isIgnored(name) {
-		d.Write404(w)
+	name := repoName(r)
+	rp, ok := d.resolveRepo(name)
+	if !ok {
+		d.Write404(w, r)
 		return
 	}
 
-	path := filepath.Join(d.c.Repo.ScanPath, name)
-	gr, err := git.Open(path, "")
+	gr, err := git.Open(rp.Path, "")
 	if err != nil {
-		d.Write404(w)
+		d.Write404(w, r)
 		return
 	}
 
 	tags, err := gr.Tags()
 	if err != nil {
 		// Non-fatal, we *should* have at least one branch to show.
-		log.Println(err)
+		slog.WarnContext(r.Context(), "reading tags", "err", err)
 	}
 
 	branches, err := gr.Branches()
 	if err != nil {
-		log.Println(err)
-		d.Write500(w)
+		slog.ErrorContext(r.Context(), "reading branches", "err", err)
+		d.Write500(w, r)
 		return
 	}
 
-	tpath := filepath.Join(d.c.Dirs.Templates, "*")
-	t := template.Must(template.ParseGlob(tpath))
+	t := template.Must(d.templates())
 
 	data := make(map[string]interface{})
 
-	data["meta"] = d.c.Meta
+	data["meta"] = d.c().Meta
 	data["name"] = name
 	data["branches"] = branches
 	data["tags"] = tags
-	data["desc"] = getDescription(path)
+	meta := rp.Meta
+	data["desc"] = meta.Description
+	data["repo"] = meta
+
+	if err := d.execute(t, w, "refs", data); err != nil {
+		slog.ErrorContext(r.Context(), "rendering template", "template", "refs", "err", err)
+		return
+	}
+}
+
+// Webhooks shows the repo's recent webhook deliveries, with
+// hooks.showLog. Only the host of each URL is shown, since the rest of
+// it may well be a secret.
+func (d *deps) Webhooks(w http.ResponseWriter, r *http.Request) {
+	name := repoName(r)
+	rp, ok := d.resolveRepo(name)
+	if !ok || d.hooks == nil || !d.c().Hooks.ShowLog {
+		d.Write404(w, r)
+		return
+	}
+
+	ds, next, err := d.hooks.Log(rp.Name, r.URL.Query().Get("before"), 50)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "reading webhook log", "err", err)
+		d.Write500(w, r)
+		return
+	}
+
+	type delivery struct {
+		*webhook.Delivery
+		Host string
+	}
+	deliveries := make([]delivery, 0, len(ds))
+	for _, dl := range ds {
+		host := ""
+		if u, err := url.Parse(dl.URL); err == nil {
+			host = u.Host
+		}
+		deliveries = append(deliveries, delivery{dl, host})
+	}
+
+	t := template.Must(d.templates())
+
+	data := make(map[string]interface{})
+	data["meta"] = d.c().Meta
+	data["name"] = name
+	data["deliveries"] = deliveries
+	data["next"] = next
+	data["desc"] = rp.Meta.Description
+	data["repo"] = rp.Meta
 
-	if err := t.ExecuteTemplate(w, "refs", data); err != nil {
-		log.Println(err)
+	if err := d.execute(t, w, "webhooks", data); err != nil {
+		slog.ErrorContext(r.Context(), "rendering template", "template", "webhooks", "err", err)
 		return
 	}
 }
 
 func (d *deps) ServeStatic(w http.ResponseWriter, r *http.Request) {
 	f := flow.Param(r.Context(), "file")
-	f = filepath.Clean(filepath.Join(d.c.Dirs.Static, f))
 
-	http.ServeFile(w, r, f)
+	http.ServeFileFS(w, r, d.static(), f)
 }
@@ -4,41 +4,48 @@ import (
 	"bytes"
 	"html/template"
 	"io"
-	"log"
+	"log/slog"
 	"net/http"
-	"path/filepath"
 	"strings"
 
 	"git.icyphox.sh/legit/git"
 )
 
-func (d *deps) Write404(w http.ResponseWriter) {
-	tpath := filepath.Join(d.c.Dirs.Templates, "*")
-	t := template.Must(template.ParseGlob(tpath))
+func (d *deps) Write404(w http.ResponseWriter, r *http.Request) {
+	t := template.Must(d.templates())
+	clearCacheHeaders(w)
 	w.WriteHeader(404)
-	if err := t.ExecuteTemplate(w, "404", nil); err != nil {
-		log.Printf("404 template: %s", err)
+	if err := d.execute(t, w, "404", nil); err != nil {
+		slog.ErrorContext(r.Context(), "rendering template", "template", "404", "err", err)
 	}
 }
 
-func (d *deps) Write500(w http.ResponseWriter) {
-	tpath := filepath.Join(d.c.Dirs.Templates, "*")
-	t := template.Must(template.ParseGlob(tpath))
+func (d *deps) Write500(w http.ResponseWriter, r *http.Request) {
+	t := template.Must(d.templates())
+	clearCacheHeaders(w)
 	w.WriteHeader(500)
-	if err := t.ExecuteTemplate(w, "500", nil); err != nil {
-		log.Printf("500 template: %s", err)
+	if err := d.execute(t, w, "500", nil); err != nil {
+		slog.ErrorContext(r.Context(), "rendering template", "template", "500", "err", err)
 	}
 }
 
-func (d *deps) listFiles(files []git.NiceTree, data map[string]any, w http.ResponseWriter) {
-	tpath := filepath.Join(d.c.Dirs.Templates, "*")
-	t := template.Must(template.ParseGlob(tpath))
+// execute renders the named template, counting failures.
+func (d *deps) execute(t *template.Template, w io.Writer, name string, data any) error {
+	err := t.ExecuteTemplate(w, name, data)
+	if err != nil {
+		templateErrors.WithLabelValues(name).Inc()
+	}
+	return err
+}
+
+func (d *deps) listFiles(files []git.NiceTree, data map[string]any, w http.ResponseWriter, r *http.Request) {
+	t := template.Must(d.templates())
 
 	data["files"] = files
-	data["meta"] = d.c.Meta
+	data["meta"] = d.c().Meta
 
-	if err := t.ExecuteTemplate(w, "tree", data); err != nil {
-		log.Println(err)
+	if err := d.execute(t, w, "tree", data); err != nil {
+		slog.ErrorContext(r.Context(), "rendering template", "template", "tree", "err", err)
 		return
 	}
 }
@@ -61,14 +68,13 @@ func countLines(r io.Reader) (int, error) {
 	}
 }
 
-func (d *deps) showFile(content string, data map[string]any, w http.ResponseWriter) {
-	tpath := filepath.Join(d.c.Dirs.Templates, "*")
-	t := template.Must(template.ParseGlob(tpath))
+func (d *deps) showFile(content string, data map[string]any, w http.ResponseWriter, r *http.Request) {
+	t := template.Must(d.templates())
 
 	lc, err := countLines(strings.NewReader(content))
 	if err != nil {
 		// Non-fatal, we'll just skip showing line numbers in the template.
-		log.Printf("counting lines: %s", err)
+		slog.WarnContext(r.Context(), "counting lines", "err", err)
 	}
 
 	lines := make([]int, lc)
@@ -80,10 +86,10 @@ func (d *deps) showFile(content string, data map[string]any, w http.ResponseWrit
 
 	data["linecount"] = lines
 	data["content"] = content
-	data["meta"] = d.c.Meta
+	data["meta"] = d.c().Meta
 
-	if err := t.ExecuteTemplate(w, "file", data); err != nil {
-		log.Println(err)
+	if err := d.execute(t, w, "file", data); err != nil {
+		slog.ErrorContext(r.Context(), "rendering template", "template", "file", "err", err)
 		return
 	}
 }
@@ -1,33 +1,85 @@
 package routes
 
 import (
+	"net/http"
 	"os"
 	"path/filepath"
-	"strings"
+
+	"git.icyphox.sh/legit/config"
+	"git.icyphox.sh/legit/git"
+	"github.com/alexedwards/flow"
 )
 
-const defaultDescription = `Unnamed repository; edit this file 'description' to name the repository.`
+// hiddenFile hides the repo whose git directory it's in.
+const hiddenFile = "legit-hidden"
 
-func getDescription(path string) (desc string) {
-	data, err := os.ReadFile(filepath.Join(path, ".git", "description"))
-	if err != nil {
-		return ""
+// isIgnored reports whether the repo called name, in directory dir of sp,
+// is ignored through repo.ignore or the scan path's own list, or isn't
+// in repo.include.
+func (d *deps) isIgnored(sp config.ScanPath, name, dir string) bool {
+	c := d.c()
+	if config.MatchAny(c.Repo.Ignore, name, dir) || config.MatchAny(sp.Ignore, name, dir) {
+		return true
 	}
+	return len(c.Repo.Include) > 0 && !config.MatchAny(c.Repo.Include, name, dir)
+}
 
-	desc = strings.TrimSpace(string(data))
-	if desc == defaultDescription {
-		return ""
+// isHidden reports whether the repo at path is hidden. Marker files in
+// its git directory decide first, then legit.hidden from its git config,
+// then the visibility of its scan path.
+func (d *deps) isHidden(sp config.ScanPath, path string, meta git.Meta) bool {
+	dir := git.Dir(path)
+	if exists(filepath.Join(dir, hiddenFile)) {
+		return true
+	}
+	if f := d.c().Repo.ExportOk; f != "" && !exists(filepath.Join(dir, f)) {
+		return true
+	}
+	if meta.Hidden != nil {
+		return *meta.Hidden
 	}
+	return sp.Visibility == config.Hidden
+}
+
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
 
-	return
+// repoName returns the name of the repo a request is for, including the
+// scan path prefix if the route has one.
+func repoName(r *http.Request) string {
+	name := flow.Param(r.Context(), "name")
+	if prefix := flow.Param(r.Context(), "prefix"); prefix != "" {
+		return prefix + "/" + name
+	}
+	return name
 }
 
-func (d *deps) isIgnored(name string) bool {
-	for _, i := range d.c.Repo.Ignore {
-		if name == i {
+// isPrefix reports whether name is the prefix of a scan path. A repo at
+// the top level by that name would be shadowed by the prefix's routes.
+func (d *deps) isPrefix(name string) bool {
+	for _, sp := range d.c().Repo.ScanPath {
+		if sp.Prefix != "" && sp.Prefix == name {
 			return true
 		}
 	}
-
 	return false
 }
+
+// readmes returns the readme file names to look for in repos of sp.
+func (d *deps) readmes(sp config.ScanPath) []string {
+	if len(sp.Readme) > 0 {
+		return sp.Readme
+	}
+	return d.c().Repo.Readme
+}
+
+// mainBranches returns the branch names to try, in order, when looking
+// for the main branch of a repo.
+func (d *deps) mainBranches(meta git.Meta) []string {
+	if meta.DefaultBranch == "" {
+		return d.c().Repo.MainBranch
+	}
+	return append([]string{meta.DefaultBranch}, d.c().Repo.MainBranch...)
+}
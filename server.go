@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"sync/atomic"
+
+	"git.icyphox.sh/legit/config"
+)
+
+// certLoader serves the TLS certificate from disk, and can reload it
+// without restarting the listener.
+type certLoader struct {
+	certFile, keyFile string
+	cert              atomic.Pointer[tls.Certificate]
+}
+
+func (l *certLoader) reload() error {
+	cert, err := tls.LoadX509KeyPair(l.certFile, l.keyFile)
+	if err != nil {
+		return fmt.Errorf("loading tls keypair: %w", err)
+	}
+	l.cert.Store(&cert)
+	return nil
+}
+
+func (l *certLoader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return l.cert.Load(), nil
+}
+
+// listen opens the configured Unix socket, or host:port otherwise.
+func listen(c *config.Config) (net.Listener, error) {
+	if c.Server.Socket != "" {
+		// Clear out a stale socket from a previous run.
+		if err := os.Remove(c.Server.Socket); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+		return net.Listen("unix", c.Server.Socket)
+	}
+
+	return net.Listen("tcp", fmt.Sprintf("%s:%d", c.Server.Host, c.Server.Port))
+}
+
+// server wraps an http.Server set up from the config.
+type server struct {
+	srv   *http.Server
+	ln    net.Listener
+	certs *certLoader
+}
+
+func newServer(c *config.Config, h http.Handler) (*server, error) {
+	s := &server{
+		srv: &http.Server{
+			Handler:           h,
+			ReadTimeout:       c.Server.ReadTimeout,
+			ReadHeaderTimeout: c.Server.ReadTimeout,
+			WriteTimeout:      c.Server.WriteTimeout,
+			IdleTimeout:       c.Server.IdleTimeout,
+			ErrorLog:          slog.NewLogLogger(slog.Default().Handler(), slog.LevelWarn),
+		},
+	}
+
+	if c.Server.TLS.Cert != "" || c.Server.TLS.Key != "" {
+		s.certs = &certLoader{certFile: c.Server.TLS.Cert, keyFile: c.Server.TLS.Key}
+		if err := s.certs.reload(); err != nil {
+			return nil, err
+		}
+		s.srv.TLSConfig = &tls.Config{
+			MinVersion:     tls.VersionTLS12,
+			GetCertificate: s.certs.getCertificate,
+		}
+	}
+
+	ln, err := listen(c)
+	if err != nil {
+		return nil, err
+	}
+	s.ln = ln
+
+	return s, nil
+}
+
+func (s *server) serve() error {
+	slog.Info("starting server", "addr", s.ln.Addr().String(), "tls", s.certs != nil)
+
+	var err error
+	if s.certs != nil {
+		err = s.srv.ServeTLS(s.ln, "", "")
+	} else {
+		err = s.srv.Serve(s.ln)
+	}
+
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+// reloadCerts picks up renewed certificates; the old ones stay in use if
+// the new ones can't be loaded.
+func (s *server) reloadCerts() {
+	if s.certs == nil {
+		return
+	}
+
+	if err := s.certs.reload(); err != nil {
+		slog.Error("reloading tls certificate", "err", err)
+		return
+	}
+	slog.Info("reloaded tls certificate")
+}
+
+func (s *server) shutdown(ctx context.Context) error {
+	return s.srv.Shutdown(ctx)
+}
@@ -4,17 +4,18 @@
 package main
 
 import (
+	"log/slog"
+
 	"golang.org/x/sys/unix"
-	"log"
 )
 
 func Unveil(path string, perms string) error {
-	log.Printf("unveil: \"%s\", %s", path, perms)
+	slog.Info("unveil", "path", path, "perms", perms)
 	return unix.Unveil(path, perms)
 }
 
 func UnveilBlock() error {
-	log.Printf("unveil: block")
+	slog.Info("unveil: block")
 	return unix.UnveilBlock()
 }
 
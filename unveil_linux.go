@@ -0,0 +1,164 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// On Linux, unveil is emulated with Landlock: Unveil collects rules and
+// UnveilBlock enforces them on every thread at once. Kernels without
+// Landlock, and binaries built with cgo, where the Go runtime can't apply
+// it to every thread, are left unrestricted and get errNoSandbox.
+
+type landlockRule struct {
+	path   string
+	access uint64
+}
+
+var landlockRules []landlockRule
+
+const (
+	landlockRead   = unix.LANDLOCK_ACCESS_FS_READ_FILE | unix.LANDLOCK_ACCESS_FS_READ_DIR
+	landlockWrite  = unix.LANDLOCK_ACCESS_FS_WRITE_FILE | unix.LANDLOCK_ACCESS_FS_TRUNCATE
+	landlockCreate = unix.LANDLOCK_ACCESS_FS_MAKE_REG | unix.LANDLOCK_ACCESS_FS_MAKE_DIR |
+		unix.LANDLOCK_ACCESS_FS_MAKE_SOCK | unix.LANDLOCK_ACCESS_FS_REMOVE_FILE |
+		unix.LANDLOCK_ACCESS_FS_REMOVE_DIR | unix.LANDLOCK_ACCESS_FS_REFER
+
+	// Rights that can be granted on a file rather than a directory.
+	landlockFile = unix.LANDLOCK_ACCESS_FS_EXECUTE | unix.LANDLOCK_ACCESS_FS_READ_FILE |
+		unix.LANDLOCK_ACCESS_FS_WRITE_FILE | unix.LANDLOCK_ACCESS_FS_TRUNCATE
+)
+
+// landlockHandled returns the rights Landlock ABI version abi restricts.
+// Anything not granted by a rule is denied.
+func landlockHandled(abi int) uint64 {
+	access := uint64(unix.LANDLOCK_ACCESS_FS_EXECUTE |
+		unix.LANDLOCK_ACCESS_FS_WRITE_FILE |
+		unix.LANDLOCK_ACCESS_FS_READ_FILE |
+		unix.LANDLOCK_ACCESS_FS_READ_DIR |
+		unix.LANDLOCK_ACCESS_FS_REMOVE_DIR |
+		unix.LANDLOCK_ACCESS_FS_REMOVE_FILE |
+		unix.LANDLOCK_ACCESS_FS_MAKE_CHAR |
+		unix.LANDLOCK_ACCESS_FS_MAKE_DIR |
+		unix.LANDLOCK_ACCESS_FS_MAKE_REG |
+		unix.LANDLOCK_ACCESS_FS_MAKE_SOCK |
+		unix.LANDLOCK_ACCESS_FS_MAKE_FIFO |
+		unix.LANDLOCK_ACCESS_FS_MAKE_BLOCK |
+		unix.LANDLOCK_ACCESS_FS_MAKE_SYM)
+	if abi >= 2 {
+		access |= unix.LANDLOCK_ACCESS_FS_REFER
+	}
+	if abi >= 3 {
+		access |= unix.LANDLOCK_ACCESS_FS_TRUNCATE
+	}
+	return access
+}
+
+// Unveil allows access to path once UnveilBlock is called. perms are as
+// for unveil(2): r, w, x and c. Creating and removing are rights on a
+// directory, so c is granted on the directory path is in, as well as
+// beneath path if it's a directory.
+func Unveil(path string, perms string) error {
+	var access uint64
+	for _, p := range perms {
+		switch p {
+		case 'r':
+			access |= landlockRead
+		case 'w':
+			access |= landlockWrite
+		case 'x':
+			access |= unix.LANDLOCK_ACCESS_FS_EXECUTE
+		case 'c':
+			access |= landlockCreate
+			landlockRules = append(landlockRules, landlockRule{filepath.Dir(path), landlockCreate})
+		default:
+			return fmt.Errorf("unveil %s: unknown permission %q", path, p)
+		}
+	}
+
+	slog.Info("unveil", "path", path, "perms", perms)
+	landlockRules = append(landlockRules, landlockRule{path, access})
+	return nil
+}
+
+func UnveilBlock() error {
+	abi, _, errno := unix.Syscall(unix.SYS_LANDLOCK_CREATE_RULESET, 0, 0, unix.LANDLOCK_CREATE_RULESET_VERSION)
+	if errno != 0 {
+		return fmt.Errorf("%w: landlock: %v", errNoSandbox, errno)
+	}
+
+	handled := landlockHandled(int(abi))
+	attr := unix.LandlockRulesetAttr{Access_fs: handled}
+	fd, _, errno := unix.Syscall(unix.SYS_LANDLOCK_CREATE_RULESET, uintptr(unsafe.Pointer(&attr)), unsafe.Sizeof(attr), 0)
+	if errno != 0 {
+		return fmt.Errorf("landlock: creating ruleset: %w", errno)
+	}
+	defer unix.Close(int(fd))
+
+	for _, rule := range landlockRules {
+		if err := addLandlockRule(int(fd), rule, handled); err != nil {
+			return err
+		}
+	}
+
+	if _, _, errno := syscall.AllThreadsSyscall(syscall.SYS_PRCTL, unix.PR_SET_NO_NEW_PRIVS, 1, 0); errno != 0 {
+		if errno == syscall.ENOTSUP {
+			return fmt.Errorf("%w: landlock can't be applied to every thread in a cgo build", errNoSandbox)
+		}
+		return fmt.Errorf("landlock: setting no_new_privs: %w", errno)
+	}
+	if _, _, errno := syscall.AllThreadsSyscall(unix.SYS_LANDLOCK_RESTRICT_SELF, fd, 0, 0); errno != 0 {
+		return fmt.Errorf("landlock: restricting: %w", errno)
+	}
+
+	slog.Info("unveil: block", "landlock_abi", abi)
+	return nil
+}
+
+func addLandlockRule(fd int, rule landlockRule, handled uint64) error {
+	f, err := os.OpenFile(rule.path, unix.O_PATH|unix.O_CLOEXEC, 0)
+	if errors.Is(err, os.ErrNotExist) {
+		// Like unveil(2), allowing access to a path that isn't there is
+		// fine; it just can't be created later.
+		slog.Warn("unveil: path doesn't exist, skipping", "path", rule.path)
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("landlock: %w", err)
+	}
+	defer f.Close()
+
+	access := rule.access & handled
+	if fi, err := f.Stat(); err == nil && !fi.IsDir() {
+		access &= landlockFile
+	}
+	if access == 0 {
+		return nil
+	}
+
+	attr := unix.LandlockPathBeneathAttr{Allowed_access: access, Parent_fd: int32(f.Fd())}
+	_, _, errno := unix.Syscall6(unix.SYS_LANDLOCK_ADD_RULE, uintptr(fd), unix.LANDLOCK_RULE_PATH_BENEATH,
+		uintptr(unsafe.Pointer(&attr)), 0, 0, 0)
+	if errno != 0 {
+		return fmt.Errorf("landlock: adding rule for %s: %w", rule.path, errno)
+	}
+	return nil
+}
+
+func UnveilPaths(paths []string, perms string) error {
+	for _, path := range paths {
+		if err := Unveil(path, perms); err != nil {
+			return err
+		}
+	}
+	return UnveilBlock()
+}
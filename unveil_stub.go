@@ -1,7 +1,7 @@
-//go:build !openbsd
-// +build !openbsd
+//go:build !openbsd && !linux
+// +build !openbsd,!linux
 
-// Stub functions for GOOS that don't support unix.Unveil()
+// Stub functions for GOOS that don't support unix.Unveil() or Landlock
 
 package main
 
@@ -10,9 +10,9 @@ func Unveil(path string, perms string) error {
 }
 
 func UnveilBlock() error {
-	return nil
+	return errNoSandbox
 }
 
 func UnveilPaths(paths []string, perms string) error {
-	return nil
+	return UnveilBlock()
 }
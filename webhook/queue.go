@@ -0,0 +1,271 @@
+package webhook
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// How many finished deliveries are kept for the log.
+const logKeep = 500
+
+// Delivery is a payload on its way to a URL.
+type Delivery struct {
+	ID        string          `json:"id"`
+	Event     string          `json:"event"`
+	Repo      string          `json:"repo"`
+	Ref       string          `json:"ref"`
+	URL       string          `json:"url"`
+	Body      json.RawMessage `json:"body"`
+	Signature string          `json:"signature,omitempty"`
+	Created   time.Time       `json:"created"`
+
+	// Next is when the next attempt is due. Status and Error are from
+	// the last attempt.
+	Attempts  int       `json:"attempts"`
+	Next      time.Time `json:"next"`
+	Status    int       `json:"status,omitempty"`
+	Error     string    `json:"error,omitempty"`
+	Delivered bool      `json:"delivered"`
+}
+
+// State is pending, delivered or failed.
+func (d *Delivery) State() string {
+	switch {
+	case d.Delivered:
+		return "delivered"
+	case d.Next.IsZero():
+		return "failed"
+	}
+	return "pending"
+}
+
+// Queue keeps deliveries on disk, one file each: in pending/ until
+// they're delivered or given up on, and in log/ after. Files are written
+// to a temporary name and renamed, so readers never see half of one.
+type Queue struct {
+	dir string
+}
+
+// Modes for the queue's subdirectories and files. The hook and legit
+// may well run as different users, who share dir's group; it's passed on
+// to what's made in it, and its members can all write there. Nobody
+// else gets in, as deliveries are about hidden repos too.
+const (
+	queueDirMode  = os.ModeSetgid | 0o770
+	queueFileMode = 0o640
+)
+
+// OpenQueue opens the queue in dir, creating its subdirectories if need
+// be. dir itself needs to be there already.
+func OpenQueue(dir string) (*Queue, error) {
+	q := &Queue{dir: dir}
+	for _, sub := range []string{"pending", "log"} {
+		path := filepath.Join(dir, sub)
+		err := os.Mkdir(path, queueDirMode)
+		if err == nil {
+			// Not up to the umask.
+			err = os.Chmod(path, queueDirMode)
+		} else if errors.Is(err, os.ErrExist) {
+			err = nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("opening webhook queue: %w", err)
+		}
+	}
+	return q, nil
+}
+
+// Add queues d to be sent.
+func (q *Queue) Add(d *Delivery) error {
+	return q.write("pending", d)
+}
+
+// Update saves d, still pending, after a failed attempt.
+func (q *Queue) Update(d *Delivery) error {
+	return q.write("pending", d)
+}
+
+// Finish moves d to the log, and drops the oldest entries from it.
+func (q *Queue) Finish(d *Delivery) error {
+	if !d.Delivered {
+		d.Next = time.Time{}
+	}
+	if err := q.write("log", d); err != nil {
+		return err
+	}
+	if err := os.Remove(q.path("pending", d.ID)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	names, err := q.list("log")
+	if err != nil {
+		return err
+	}
+	for _, name := range names[:max(0, len(names)-logKeep)] {
+		os.Remove(filepath.Join(q.dir, "log", name))
+	}
+	return nil
+}
+
+// Due returns the pending deliveries whose next attempt is due by now,
+// oldest first.
+func (q *Queue) Due(now time.Time) ([]*Delivery, error) {
+	ds, err := q.read("pending")
+	if err != nil {
+		return nil, err
+	}
+
+	var due []*Delivery
+	for _, d := range ds {
+		if !d.Next.After(now) {
+			due = append(due, d)
+		}
+	}
+	return due, nil
+}
+
+// logScan is how many deliveries Log reads at most, however few of them
+// are for the repo it's after.
+const logScan = 200
+
+// Log returns up to n of repo's deliveries, pending or not, newest
+// first, starting after the one with ID before if it's set. next is what
+// to pass as before for older ones, or empty if there are none.
+func (q *Queue) Log(repo, before string, n int) (ds []*Delivery, next string, err error) {
+	// Delivery files are named after their IDs, which sort by when
+	// they were made. A delivery being finished can be in both for a
+	// moment.
+	subs := map[string]string{}
+	for _, sub := range []string{"pending", "log"} {
+		names, err := q.list(sub)
+		if err != nil {
+			return nil, "", err
+		}
+		for _, name := range names {
+			subs[name] = sub
+		}
+	}
+	names := make([]string, 0, len(subs))
+	for name := range subs {
+		if id := strings.TrimSuffix(name, ".json"); before == "" || id < before {
+			names = append(names, name)
+		}
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(names)))
+
+	for i, name := range names {
+		if i == logScan {
+			return ds, strings.TrimSuffix(names[i-1], ".json"), nil
+		}
+		d, err := q.readFile(subs[name], name)
+		if d == nil && err == nil && subs[name] == "pending" {
+			// Finished while we were looking.
+			d, err = q.readFile("log", name)
+		}
+		if err != nil {
+			return nil, "", err
+		}
+		if d != nil && d.Repo == repo {
+			ds = append(ds, d)
+		}
+		if len(ds) >= n && i < len(names)-1 {
+			return ds, strings.TrimSuffix(name, ".json"), nil
+		}
+	}
+	return ds, "", nil
+}
+
+func (q *Queue) path(sub, id string) string {
+	return filepath.Join(q.dir, sub, id+".json")
+}
+
+func (q *Queue) write(sub string, d *Delivery) error {
+	b, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.CreateTemp(filepath.Join(q.dir, sub), ".tmp-")
+	if err != nil {
+		return err
+	}
+	err = f.Chmod(queueFileMode)
+	if err == nil {
+		_, err = f.Write(b)
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), q.path(sub, d.ID))
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return fmt.Errorf("saving delivery %s: %w", d.ID, err)
+	}
+	return nil
+}
+
+// list returns the names of the delivery files in sub, oldest first.
+func (q *Queue) list(sub string) ([]string, error) {
+	entries, err := os.ReadDir(filepath.Join(q.dir, sub))
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, e := range entries {
+		if strings.HasSuffix(e.Name(), ".json") && !strings.HasPrefix(e.Name(), ".") {
+			names = append(names, e.Name())
+		}
+	}
+	// IDs start with a timestamp, and are all the same length for the
+	// next couple of centuries.
+	sort.Strings(names)
+	return names, nil
+}
+
+func (q *Queue) read(sub string) ([]*Delivery, error) {
+	names, err := q.list(sub)
+	if err != nil {
+		return nil, err
+	}
+
+	var ds []*Delivery
+	for _, name := range names {
+		d, err := q.readFile(sub, name)
+		if err != nil {
+			return nil, err
+		}
+		if d != nil {
+			ds = append(ds, d)
+		}
+	}
+	return ds, nil
+}
+
+// readFile reads the delivery in sub/name, or returns nil if it's gone
+// or can't be made sense of.
+func (q *Queue) readFile(sub, name string) (*Delivery, error) {
+	b, err := os.ReadFile(filepath.Join(q.dir, sub, name))
+	if errors.Is(err, os.ErrNotExist) {
+		// Finished while we were looking.
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var d Delivery
+	if err := json.Unmarshal(b, &d); err != nil {
+		// Skipped rather than holding up the rest.
+		slog.Warn("webhook: bad delivery in queue", "file", name, "err", err)
+		return nil, nil
+	}
+	return &d, nil
+}
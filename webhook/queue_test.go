@@ -0,0 +1,140 @@
+package webhook
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// delivery makes the nth delivery for repo, with IDs sorting by n.
+func delivery(repo string, n int) *Delivery {
+	return &Delivery{
+		ID:      fmt.Sprintf("%019d-%08x", n, n),
+		Event:   "push",
+		Repo:    repo,
+		Body:    []byte("{}"),
+		Created: time.Unix(int64(n), 0),
+	}
+}
+
+func count(t *testing.T, q *Queue, sub string) int {
+	t.Helper()
+	names, err := q.list(sub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(names)
+}
+
+func TestFinish(t *testing.T) {
+	q := openQueue(t)
+	for _, sub := range []string{"pending", "log"} {
+		fi, err := os.Stat(filepath.Join(q.dir, sub))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := os.ModeDir | os.ModeSetgid | 0o770; fi.Mode() != want {
+			t.Errorf("%s is %v, want %v", sub, fi.Mode(), want)
+		}
+	}
+
+	d := delivery("test.git", 1)
+	d.Next = time.Now()
+	if err := q.Add(d); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(q.path("pending", d.ID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode() != 0o640 {
+		t.Errorf("delivery file is %v, want %v", fi.Mode(), os.FileMode(0o640))
+	}
+	if err := q.Finish(d); err != nil {
+		t.Fatal(err)
+	}
+	if n := count(t, q, "pending"); n != 0 {
+		t.Errorf("%d pending after finishing", n)
+	}
+	if n := count(t, q, "log"); n != 1 {
+		t.Errorf("%d logged after finishing", n)
+	}
+	if d.State() != "failed" {
+		t.Errorf("undelivered delivery is %s once finished", d.State())
+	}
+
+	// The oldest are dropped past logKeep.
+	for i := 2; i <= logKeep+10; i++ {
+		d := delivery("test.git", i)
+		if err := q.Add(d); err != nil {
+			t.Fatal(err)
+		}
+		d.Delivered = true
+		if err := q.Finish(d); err != nil {
+			t.Fatal(err)
+		}
+	}
+	names, err := q.list("log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != logKeep {
+		t.Fatalf("%d logged, want %d", len(names), logKeep)
+	}
+	if want := delivery("", 11).ID + ".json"; names[0] != want {
+		t.Errorf("oldest logged is %s, want %s", names[0], want)
+	}
+}
+
+func TestLog(t *testing.T) {
+	q := openQueue(t)
+
+	// Every third is another repo's, and the newest few are pending.
+	var want []string
+	for i := 1; i <= 120; i++ {
+		repo := "test.git"
+		if i%3 == 0 {
+			repo = "other.git"
+		}
+		d := delivery(repo, i)
+		if err := q.Add(d); err != nil {
+			t.Fatal(err)
+		}
+		if i <= 110 {
+			if err := q.Finish(d); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if repo == "test.git" {
+			want = append([]string{d.ID}, want...)
+		}
+	}
+
+	var got []string
+	before := ""
+	for pages := 1; ; pages++ {
+		ds, next, err := q.Log("test.git", before, 30)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(ds) > 30 {
+			t.Fatalf("page %d has %d", pages, len(ds))
+		}
+		for _, d := range ds {
+			got = append(got, d.ID)
+		}
+		if next == "" {
+			break
+		}
+		if pages == 10 {
+			t.Fatal("too many pages")
+		}
+		before = next
+	}
+
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("got %v\nwant %v", got, want)
+	}
+}
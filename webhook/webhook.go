@@ -0,0 +1,260 @@
+// Package webhook posts push events to the URLs configured for a repo.
+// Deliveries are queued on disk by the post-receive hook, and sent, and
+// retried if need be, by the server.
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"git.icyphox.sh/legit/config"
+	"git.icyphox.sh/legit/git"
+	"github.com/go-git/go-git/v5/plumbing"
+)
+
+// Payloads list at most this many commits; Total has the full count.
+const maxCommits = 20
+
+// RefUpdate is a line of post-receive input.
+type RefUpdate struct {
+	Old, New plumbing.Hash
+	Ref      string
+}
+
+// ParseUpdates reads post-receive input: "<old> <new> <ref>" lines.
+func ParseUpdates(r io.Reader) ([]RefUpdate, error) {
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var updates []RefUpdate
+	for _, line := range strings.Split(strings.TrimSpace(string(b)), "\n") {
+		if line == "" {
+			continue
+		}
+		f := strings.Fields(line)
+		if len(f) != 3 || len(f[0]) != 40 || len(f[1]) != 40 {
+			return nil, fmt.Errorf("bad ref update %q", line)
+		}
+		updates = append(updates, RefUpdate{Old: plumbing.NewHash(f[0]), New: plumbing.NewHash(f[1]), Ref: f[2]})
+	}
+	return updates, nil
+}
+
+// Push is the payload sent for a ref update.
+type Push struct {
+	Repo    string   `json:"repo"`
+	Ref     string   `json:"ref"`
+	Old     string   `json:"old"`
+	New     string   `json:"new"`
+	Created bool     `json:"created"`
+	Deleted bool     `json:"deleted"`
+	Pusher  string   `json:"pusher,omitempty"`
+	Commits []Commit `json:"commits"`
+	Total   int      `json:"total_commits"`
+}
+
+type Commit struct {
+	ID        string    `json:"id"`
+	Message   string    `json:"message"`
+	Author    Person    `json:"author"`
+	Timestamp time.Time `json:"timestamp"`
+	URL       string    `json:"url,omitempty"`
+}
+
+type Person struct {
+	Name  string `json:"name"`
+	Email string `json:"email"`
+}
+
+// NewPush builds the payload for u, a push to the repo called name that
+// srv serves. Commit URLs are only set if baseURL is.
+func NewPush(srv *git.Server, name string, u RefUpdate, pusher, baseURL string) (*Push, error) {
+	p := &Push{
+		Repo:    name,
+		Ref:     u.Ref,
+		Old:     u.Old.String(),
+		New:     u.New.String(),
+		Created: u.Old.IsZero(),
+		Deleted: u.New.IsZero(),
+		Pusher:  pusher,
+		Commits: []Commit{},
+	}
+
+	commits, err := srv.Pushed(u.Ref, u.Old, u.New)
+	if err != nil {
+		return nil, err
+	}
+	p.Total = len(commits)
+	for _, c := range commits[:min(len(commits), maxCommits)] {
+		pc := Commit{
+			ID:        c.Hash.String(),
+			Message:   c.Message,
+			Author:    Person{Name: c.Author.Name, Email: c.Author.Email},
+			Timestamp: c.Author.When,
+		}
+		if baseURL != "" {
+			pc.URL = baseURL + "/" + name + "/commit/" + pc.ID
+		}
+		p.Commits = append(p.Commits, pc)
+	}
+	return p, nil
+}
+
+// Deliveries returns a delivery of p to each webhook in hooks that's
+// for the repo.
+func Deliveries(hooks []config.Webhook, p *Push) ([]*Delivery, error) {
+	body, err := json.Marshal(p)
+	if err != nil {
+		return nil, err
+	}
+
+	var ds []*Delivery
+	for _, wh := range hooks {
+		if len(wh.Repos) > 0 && !config.MatchAny(wh.Repos, p.Repo) {
+			continue
+		}
+		d := &Delivery{
+			ID:      newID(),
+			Event:   "push",
+			Repo:    p.Repo,
+			Ref:     p.Ref,
+			URL:     wh.URL,
+			Body:    body,
+			Created: time.Now(),
+		}
+		if wh.Secret != "" {
+			d.Signature = Sign(wh.Secret, body)
+		}
+		d.Next = d.Created
+		ds = append(ds, d)
+	}
+	return ds, nil
+}
+
+// Sign returns the signature of body for the X-Legit-Signature-256
+// header: "sha256=" and the hex HMAC-SHA256 of body keyed with secret.
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// IDs sort by when they were made.
+func newID() string {
+	b := make([]byte, 4)
+	rand.Read(b)
+	return fmt.Sprintf("%d-%s", time.Now().UnixNano(), hex.EncodeToString(b))
+}
+
+var client = &http.Client{Timeout: 10 * time.Second}
+
+// send posts d once, and reports the status it got, if any.
+func send(ctx context.Context, d *Delivery) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", d.URL, bytes.NewReader(d.Body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "legit-webhook")
+	req.Header.Set("X-Legit-Event", d.Event)
+	req.Header.Set("X-Legit-Delivery", d.ID)
+	if d.Signature != "" {
+		req.Header.Set("X-Legit-Signature-256", d.Signature)
+	}
+
+	res, err := client.Do(req)
+	var uerr *url.Error
+	if errors.As(err, &uerr) {
+		// Without the URL, which may have a secret in it and ends up in
+		// the delivery log.
+		return 0, fmt.Errorf("%s: %w", uerr.Op, uerr.Err)
+	} else if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(res.Body, 64<<10))
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return res.StatusCode, fmt.Errorf("got %s", res.Status)
+	}
+	return res.StatusCode, nil
+}
+
+// Deliveries that fail are retried after retryBase, then twice that,
+// and so on up to retryMax.
+const (
+	retryBase = 30 * time.Second
+	retryMax  = time.Hour
+)
+
+// How often the queue is checked for deliveries that are due.
+const pollInterval = 5 * time.Second
+
+// Run sends deliveries from q as they come due, until ctx is done.
+// Each is tried up to attempts times.
+func Run(ctx context.Context, q *Queue, attempts int) {
+	t := time.NewTicker(pollInterval)
+	defer t.Stop()
+
+	for {
+		due, err := q.Due(time.Now())
+		if err != nil {
+			slog.Error("webhook: reading queue", "err", err)
+		}
+		for _, d := range due {
+			if ctx.Err() != nil {
+				return
+			}
+			deliver(ctx, q, d, attempts)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+func deliver(ctx context.Context, q *Queue, d *Delivery, attempts int) {
+	status, err := send(ctx, d)
+	d.Attempts++
+	d.Status = status
+	d.Error = ""
+	if err != nil {
+		d.Error = err.Error()
+	}
+
+	log := slog.With("id", d.ID, "repo", d.Repo, "url", d.URL, "attempt", d.Attempts)
+	switch {
+	case err == nil:
+		d.Delivered = true
+		log.Info("webhook: delivered", "status", status)
+		err = q.Finish(d)
+	case d.Attempts >= attempts:
+		log.Warn("webhook: giving up", "err", d.Error)
+		err = q.Finish(d)
+	default:
+		d.Next = time.Now().Add(min(retryBase<<(d.Attempts-1), retryMax))
+		log.Warn("webhook: failed, will retry", "err", d.Error, "next", d.Next)
+		err = q.Update(d)
+	}
+	if err != nil {
+		slog.Error("webhook: updating queue", "id", d.ID, "err", err)
+	}
+}
@@ -0,0 +1,261 @@
+package webhook
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"git.icyphox.sh/legit/config"
+	"git.icyphox.sh/legit/git"
+	"github.com/go-git/go-git/v5/plumbing"
+)
+
+func openQueue(t *testing.T) *Queue {
+	t.Helper()
+	q, err := OpenQueue(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return q
+}
+
+// verify checks r's signature the way a receiver would.
+func verify(secret string, body []byte, r *http.Request) bool {
+	sig, ok := strings.CutPrefix(r.Header.Get("X-Legit-Signature-256"), "sha256=")
+	if !ok {
+		return false
+	}
+	got, err := hex.DecodeString(sig)
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hmac.Equal(got, mac.Sum(nil))
+}
+
+func TestRun(t *testing.T) {
+	got := make(chan *http.Request, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if !verify("hunter2", body, r) {
+			t.Errorf("bad signature %q", r.Header.Get("X-Legit-Signature-256"))
+		}
+		var p Push
+		if err := json.Unmarshal(body, &p); err != nil || p.Repo != "test.git" {
+			t.Errorf("got %s, %v", body, err)
+		}
+		got <- r
+	}))
+	defer srv.Close()
+
+	q := openQueue(t)
+	hooks := []config.Webhook{
+		{URL: srv.URL + "/signed", Secret: "hunter2"},
+		{URL: srv.URL + "/other", Repos: []string{"other.git"}},
+	}
+	ds, err := Deliveries(hooks, &Push{Repo: "test.git", Ref: "refs/heads/master"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ds) != 1 {
+		t.Fatalf("got %d deliveries, want 1", len(ds))
+	}
+	if err := q.Add(ds[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go Run(ctx, q, 3)
+
+	select {
+	case r := <-got:
+		if r.URL.Path != "/signed" || r.Header.Get("X-Legit-Event") != "push" || r.Header.Get("X-Legit-Delivery") != ds[0].ID {
+			t.Errorf("got %s with %v", r.URL, r.Header)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("nothing delivered")
+	}
+
+	// It's logged as delivered once Run gets to it.
+	for i := 0; ; i++ {
+		log, _, err := q.Log("test.git", "", 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(log) == 1 && log[0].State() == "delivered" {
+			break
+		}
+		if i == 100 {
+			t.Fatalf("log has %v", log)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRetry(t *testing.T) {
+	tries := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tries++
+		http.Error(w, "down", http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	q := openQueue(t)
+	d := &Delivery{ID: newID(), Event: "push", Repo: "test.git", URL: srv.URL, Body: []byte("{}"), Created: time.Now()}
+	if err := q.Add(d); err != nil {
+		t.Fatal(err)
+	}
+
+	const attempts = 4
+	for i := 1; i <= attempts; i++ {
+		start := time.Now()
+		deliver(context.Background(), q, d, attempts)
+		if d.Attempts != i || d.Status != http.StatusServiceUnavailable || d.Error == "" {
+			t.Fatalf("attempt %d: got %+v", i, d)
+		}
+
+		due, err := q.Due(time.Now().Add(2 * time.Hour))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i == attempts {
+			if len(due) != 0 {
+				t.Fatalf("still pending after %d attempts", i)
+			}
+			break
+		}
+
+		// Backing off from retryBase, doubling each time.
+		want := retryBase << (i - 1)
+		if wait := d.Next.Sub(start); wait < want || wait > want+time.Second {
+			t.Errorf("attempt %d: next in %v, want %v", i, wait, want)
+		}
+		if len(due) != 1 || due[0].Attempts != i {
+			t.Fatalf("attempt %d: pending %v", i, due)
+		}
+	}
+	if tries != attempts {
+		t.Errorf("tried %d times, want %d", tries, attempts)
+	}
+
+	log, _, err := q.Log("test.git", "", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(log) != 1 || log[0].State() != "failed" || log[0].Attempts != attempts {
+		t.Errorf("log has %v", log)
+	}
+}
+
+func runGit(t *testing.T, dir string, args ...string) string {
+	t.Helper()
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(),
+		"GIT_CONFIG_GLOBAL=/dev/null",
+		"GIT_CONFIG_NOSYSTEM=1",
+		"GIT_AUTHOR_NAME=legit", "GIT_AUTHOR_EMAIL=legit@example.com",
+		"GIT_COMMITTER_NAME=legit", "GIT_COMMITTER_EMAIL=legit@example.com",
+	)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("git %s: %v\n%s", strings.Join(args, " "), err, out)
+	}
+	return strings.TrimSpace(string(out))
+}
+
+func TestNewPush(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git isn't installed")
+	}
+
+	dir := t.TempDir()
+	runGit(t, dir, "init", "-q", "-b", "master")
+	n := 0
+	commit := func(msg string) plumbing.Hash {
+		t.Helper()
+		// A minute apart, so they sort.
+		n++
+		date := fmt.Sprintf("2020-01-01T%02d:%02d:00Z", n/60, n%60)
+		t.Setenv("GIT_AUTHOR_DATE", date)
+		t.Setenv("GIT_COMMITTER_DATE", date)
+		if err := os.WriteFile(filepath.Join(dir, "file"), []byte(msg), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		runGit(t, dir, "add", "-A")
+		runGit(t, dir, "commit", "-q", "-m", msg)
+		return plumbing.NewHash(runGit(t, dir, "rev-parse", "HEAD"))
+	}
+
+	// master has one and two; what's pushed below branches off it with
+	// three and four, and then some, and is on no branch.
+	one := commit("one")
+	two := commit("two")
+	runGit(t, dir, "checkout", "-q", "-b", "topic")
+	commit("three")
+	four := commit("four")
+	for i := 0; i < maxCommits+5; i++ {
+		commit(fmt.Sprint("more ", i))
+	}
+	many := plumbing.NewHash(runGit(t, dir, "rev-parse", "HEAD"))
+	runGit(t, dir, "checkout", "-q", "master")
+	runGit(t, dir, "branch", "-q", "-D", "topic")
+
+	srv, err := git.OpenServer(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		ref      string
+		old, new plumbing.Hash
+		messages []string
+		total    int
+	}{
+		{"updated", "refs/heads/master", one, two, []string{"two"}, 1},
+		// New refs get what isn't on any other branch.
+		{"created", "refs/heads/new", plumbing.ZeroHash, four, []string{"four", "three"}, 2},
+		{"created on master", "refs/heads/copy", plumbing.ZeroHash, two, nil, 0},
+		{"deleted", "refs/heads/topic", four, plumbing.ZeroHash, nil, 0},
+		{"many", "refs/heads/new", two, many, nil, maxCommits + 7},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := NewPush(srv, "test.git", RefUpdate{Old: tt.old, New: tt.new, Ref: tt.ref}, "alice", "https://git.example.com")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if p.Created != tt.old.IsZero() || p.Deleted != tt.new.IsZero() || p.Pusher != "alice" || p.Ref != tt.ref {
+				t.Errorf("got %+v", p)
+			}
+			if p.Total != tt.total || len(p.Commits) != min(tt.total, maxCommits) {
+				t.Fatalf("got %d commits of %d, want %d", len(p.Commits), p.Total, tt.total)
+			}
+			for i, msg := range tt.messages {
+				if got := strings.TrimSpace(p.Commits[i].Message); got != msg {
+					t.Errorf("commit %d is %q, want %q", i, got, msg)
+				}
+			}
+			for _, c := range p.Commits {
+				if c.URL != "https://git.example.com/test.git/commit/"+c.ID {
+					t.Errorf("commit URL %s", c.URL)
+				}
+			}
+		})
+	}
+}